@@ -0,0 +1,188 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// WorkerPool runs message handlers asynchronously, out of the
+// attendants' read loops, in a bounded number of goroutines and
+// with a bounded queue. When the queue is full, the messages are
+// rejected (see WithMessageRejected) instead of blocking the
+// attendant. Pools are created with NewWorkerPool (no ordering
+// guarantees) or NewOrderedWorkerPool (messages of the same
+// attendant are handled one at a time, in arrival order), and
+// may be shared among several protocols and funnels.
+type WorkerPool struct {
+	queues    []chan func()
+	depth     int64
+	rejected  uint64
+	mutex     sync.RWMutex
+	closed    bool
+	waitGroup sync.WaitGroup
+}
+
+// Creates a pool with the given amount of workers, taking the
+// tasks from a single queue with the given capacity.
+func NewWorkerPool(workers, capacity int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	pool := &WorkerPool{queues: []chan func(){make(chan func(), capacity)}}
+	for index := 0; index < workers; index++ {
+		pool.work(pool.queues[0])
+	}
+	return pool
+}
+
+// Creates a pool with the given amount of workers, each one
+// with its own queue with the given capacity. Each attendant
+// is always served by the same worker, so its messages are
+// handled in arrival order.
+func NewOrderedWorkerPool(workers, capacity int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	pool := &WorkerPool{queues: make([]chan func(), workers)}
+	for index := range pool.queues {
+		pool.queues[index] = make(chan func(), capacity)
+		pool.work(pool.queues[index])
+	}
+	return pool
+}
+
+// Launches a worker for a queue.
+func (pool *WorkerPool) work(queue chan func()) {
+	pool.waitGroup.Add(1)
+	go func() {
+		defer pool.waitGroup.Done()
+		for task := range queue {
+			atomic.AddInt64(&pool.depth, -1)
+			task()
+		}
+	}()
+}
+
+// Chooses the queue of an attendant.
+func (pool *WorkerPool) queueOf(attendant *chasqui.Attendant) chan func() {
+	if len(pool.queues) == 1 {
+		return pool.queues[0]
+	}
+	hash := uint64(reflect.ValueOf(attendant).Pointer()) * 11400714819323198485
+	return pool.queues[(hash>>32)%uint64(len(pool.queues))]
+}
+
+// Queues a task for an attendant, without blocking. It returns
+// false if the queue is full or the pool is closed.
+func (pool *WorkerPool) submit(attendant *chasqui.Attendant, task func()) bool {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	if !pool.closed {
+		atomic.AddInt64(&pool.depth, 1)
+		select {
+		case pool.queueOf(attendant) <- task:
+			return true
+		default:
+			atomic.AddInt64(&pool.depth, -1)
+		}
+	}
+	atomic.AddUint64(&pool.rejected, 1)
+	return false
+}
+
+// The amount of tasks waiting in the queues.
+func (pool *WorkerPool) QueueDepth() int {
+	return int(atomic.LoadInt64(&pool.depth))
+}
+
+// The amount of tasks rejected so far.
+func (pool *WorkerPool) Rejected() uint64 {
+	return atomic.LoadUint64(&pool.rejected)
+}
+
+// Stops accepting tasks, and waits for the queued ones to
+// finish. Messages arriving later are rejected.
+func (pool *WorkerPool) Close() {
+	pool.mutex.Lock()
+	if !pool.closed {
+		pool.closed = true
+		for _, queue := range pool.queues {
+			close(queue)
+		}
+	}
+	pool.mutex.Unlock()
+	pool.waitGroup.Wait()
+}
+
+// Wraps a handler so it runs in a worker pool. This function
+// is the intended way to run a single command asynchronously,
+// while building the handlers of a protocol. Panics in the
+// handler are reported to the funnel serving the server, as
+// usual. Deadlines (see TimeoutProvider) keep running until
+// the handler ends in the pool. State keys are safe to use
+// from the pool, but the attendant's raw context is not: the
+// handlers using it must not run concurrently with any other
+// handler of the attendant, so they should run inline.
+func Async(pool *WorkerPool, handler MessageHandler) MessageHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		funnel, _ := ServingFunnel(server)
+		finish := detachMessage(message)
+		accepted := pool.submit(attendant, func() {
+			if finish != nil {
+				defer finish()
+			}
+			defer func() {
+				if recovered := recover(); recovered != nil && funnel != nil {
+					funnel.messagePanic(server, attendant, message, recovered)
+				}
+			}()
+			handler(server, attendant, message)
+		})
+		if !accepted {
+			if finish != nil {
+				finish()
+			}
+			if funnel != nil {
+				funnel.messageRejected(server, attendant, message)
+			}
+		}
+	}
+}
+
+// Makes a middleware running the handlers in a worker pool.
+// This is the intended way to run all the handlers of a
+// protocol asynchronously, as the first of its middlewares.
+func AsyncMiddleware(pool *WorkerPool) MessageMiddleware {
+	return func(handler MessageHandler) MessageHandler {
+		return Async(pool, handler)
+	}
+}
+
+// Logs and reports a message rejected by a saturated pool.
+func (funnel *ProtocolsFunnel) messageRejected(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+	funnel.logger.Warn("message rejected", "server", server, "attendant", attendant, "command", message.Command())
+	if funnel.onMessageRejected != nil {
+		funnel.onMessageRejected(server, attendant, message)
+	}
+}
+
+// Option to set the "message rejected" callback to handle when a
+// message to be handled asynchronously cannot be queued, since its
+// worker pool is saturated (or closed).
+func WithMessageRejected(callback MessageHandler) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onMessageRejected = callback
+	}
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+var ErrMalformedEntry = errors.New("malformed credentials entry")
+
+// The parameters of argon2id hashes.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Reasonable argon2id parameters for interactive logins.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Hashes a password with bcrypt, for a credentials file.
+func HashBcrypt(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+// Hashes a password with argon2id, in the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$key), for a
+// credentials file.
+func HashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Iterations,
+		params.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Tells whether a password matches a bcrypt or argon2id hash.
+func VerifyHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+// Tells whether a password matches an argon2id hash.
+func verifyArgon2id(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrUnsupportedHash
+	}
+	var version int
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnsupportedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations,
+		&params.Parallelism); err != nil {
+		return false, ErrUnsupportedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnsupportedHash
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrUnsupportedHash
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism,
+		uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// A hash to compare against when the user does not exist, so the
+// response time does not tell whether it exists.
+var dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// Gets the dummy hash, creating it the first time.
+func getDummyHash() string {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = HashBcrypt("", bcrypt.DefaultCost)
+	})
+	return dummyHash.hash
+}
+
+// A credentials file entry.
+type fileEntry struct {
+	hash  string
+	roles []string
+}
+
+// FileStore authenticates users against a credentials file. Each
+// line of the file has the form name:hash[:role1,role2,...], where
+// hash is a bcrypt or argon2id one (see HashBcrypt and HashArgon2id).
+// Empty lines and lines starting with # are ignored.
+type FileStore struct {
+	path    string
+	mutex   sync.RWMutex
+	entries map[string]fileEntry
+}
+
+// Creates a store out of a credentials file, loading it.
+func LoadFileStore(path string) (*FileStore, error) {
+	store := &FileStore{path: path}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Loads the credentials file again. On failure, the previous
+// entries are kept.
+func (store *FileStore) Reload() error {
+	file, err := os.Open(store.path)
+	if err != nil {
+		return err
+	}
+	// noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	entries := make(map[string]fileEntry)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("%w: %s:%d", ErrMalformedEntry, store.path, number)
+		}
+		entry := fileEntry{hash: fields[1]}
+		if len(fields) == 3 && fields[2] != "" {
+			entry.roles = strings.Split(fields[2], ",")
+		}
+		entries[fields[0]] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entries = entries
+	return nil
+}
+
+func (store *FileStore) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	store.mutex.RLock()
+	entry, ok := store.entries[name]
+	store.mutex.RUnlock()
+	if !ok {
+		// noinspection GoUnhandledErrorResult
+		VerifyHash(getDummyHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+	if matches, err := VerifyHash(entry.hash, password); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	} else if !matches {
+		return nil, ErrInvalidCredentials
+	}
+	return &User{Name: name, Roles: append([]string(nil), entry.roles...)}, nil
+}
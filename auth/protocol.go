@@ -0,0 +1,438 @@
+package auth
+
+import (
+	"errors"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui-protocols"
+	"github.com/universe-10th/chasqui/types"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// What to do when a user logs in while already logged in from
+// another attendant.
+type DuplicateLoginPolicy int
+
+const (
+	// Log the previous attendants out (telling them so) and log the
+	// new one in.
+	GhostPrevious DuplicateLoginPolicy = iota
+	// Refuse the new login.
+	RejectNew
+	// Allow the user to be logged in from several attendants.
+	AllowMultiple
+)
+
+// The commands the protocol understands.
+type Commands struct {
+	Login  string
+	Logout string
+}
+
+// The commands the protocol replies with. Replies to RPC messages
+// (see protocols.WithRPC) use their result and error replies
+// instead: LoggedIn and LoggedOut become results, and the rest
+// become error codes.
+type Replies struct {
+	// Sent, with the user name, when the login succeeds.
+	LoggedIn string
+	// Sent when the logout succeeds.
+	LoggedOut string
+	// Sent when logging in an attendant which is already logged in.
+	AlreadyLoggedIn string
+	// Sent when logging out an attendant which is not logged in.
+	NotLoggedIn string
+	// Sent when the name or password are wrong.
+	InvalidCredentials string
+	// Sent, with the user name, when the user is locked out.
+	LockedOut string
+	// Sent, with the user name, when the user is already logged in
+	// and the policy is RejectNew.
+	DuplicateLogin string
+	// Sent to the previous attendants when the policy is GhostPrevious.
+	Ghosted string
+	// Sent, with the command, when a command requires a login.
+	LoginRequired string
+	// Sent when the credential store fails.
+	Error string
+}
+
+// The settings of an auth protocol. Zero fields take their defaults.
+type Settings struct {
+	Commands        Commands
+	Replies         Replies
+	DuplicateLogins DuplicateLoginPolicy
+	// The amount of failed logins which locks a user out, counting
+	// the ones not farther than LockoutDuration from each other. Zero
+	// disables the lockout.
+	MaxAttempts int
+	// How long a user stays locked out. Defaults to 15 minutes.
+	LockoutDuration time.Duration
+	// Invoked when an attendant logs in.
+	OnLoggedIn func(server *chasqui.Server, attendant *chasqui.Attendant, user *User)
+	// Invoked when an attendant logs out, is ghosted or disconnects
+	// while logged in.
+	OnLoggedOut func(server *chasqui.Server, attendant *chasqui.Attendant, user *User)
+}
+
+// Sets the default value of a setting, if absent.
+func defaultTo(value *string, defaultValue string) {
+	if *value == "" {
+		*value = defaultValue
+	}
+}
+
+// Gets the settings with the defaults for the absent fields.
+func (settings Settings) withDefaults() Settings {
+	defaultTo(&settings.Commands.Login, "LOGIN")
+	defaultTo(&settings.Commands.Logout, "LOGOUT")
+	defaultTo(&settings.Replies.LoggedIn, "LOGGED_IN")
+	defaultTo(&settings.Replies.LoggedOut, "LOGGED_OUT")
+	defaultTo(&settings.Replies.AlreadyLoggedIn, "ALREADY_LOGGED_IN")
+	defaultTo(&settings.Replies.NotLoggedIn, "NOT_LOGGED_IN")
+	defaultTo(&settings.Replies.InvalidCredentials, "INVALID_CREDENTIALS")
+	defaultTo(&settings.Replies.LockedOut, "LOCKED_OUT")
+	defaultTo(&settings.Replies.DuplicateLogin, "DUPLICATE_LOGIN")
+	defaultTo(&settings.Replies.Ghosted, "GHOSTED")
+	defaultTo(&settings.Replies.LoginRequired, "LOGIN_REQUIRED")
+	defaultTo(&settings.Replies.Error, "AUTH_ERROR")
+	if settings.LockoutDuration <= 0 {
+		settings.LockoutDuration = 15 * time.Minute
+	}
+	return settings
+}
+
+// The sessions of a server.
+type sessions struct {
+	mutex      sync.RWMutex
+	users      map[*chasqui.Attendant]*User
+	attendants map[string][]*chasqui.Attendant
+}
+
+// Adds a session.
+func (sessions *sessions) add(attendant *chasqui.Attendant, user *User) {
+	sessions.users[attendant] = user
+	sessions.attendants[user.Name] = append(sessions.attendants[user.Name], attendant)
+}
+
+// Removes a session, returning its user, if any.
+func (sessions *sessions) remove(attendant *chasqui.Attendant) (*User, bool) {
+	user, ok := sessions.users[attendant]
+	if !ok {
+		return nil, false
+	}
+	delete(sessions.users, attendant)
+	var remaining []*chasqui.Attendant
+	for _, other := range sessions.attendants[user.Name] {
+		if other != attendant {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(sessions.attendants, user.Name)
+	} else {
+		sessions.attendants[user.Name] = remaining
+	}
+	return user, true
+}
+
+// The recent failed logins of a user.
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Protocol is the authentication protocol. It provides the Service
+// service, so other protocols can require it (see Required).
+type Protocol struct {
+	store       CredentialStore
+	settings    Settings
+	sessionsKey *protocols.ServerStateKey
+	mutex       sync.Mutex
+	failures    map[string]*failures
+	lastSweep   time.Time
+}
+
+// Creates an auth protocol using the given credential store.
+func New(store CredentialStore, settings Settings) *Protocol {
+	protocol := &Protocol{store: store, settings: settings.withDefaults(), failures: make(map[string]*failures)}
+	protocol.sessionsKey = protocols.NewServerStateKey(protocol, "auth.sessions", (*sessions)(nil))
+	return protocol
+}
+
+func (protocol *Protocol) Name() string {
+	return "auth"
+}
+
+func (protocol *Protocol) Provides() []reflect.Type {
+	return []reflect.Type{Service}
+}
+
+func (protocol *Protocol) ServerStateKeys() []*protocols.ServerStateKey {
+	return []*protocols.ServerStateKey{protocol.sessionsKey}
+}
+
+// Gets the sessions of a server, which are allocated by the funnel.
+func (protocol *Protocol) sessions(server *chasqui.Server) (*sessions, bool) {
+	value, ok := protocol.sessionsKey.Get(server)
+	if !ok {
+		return nil, false
+	}
+	return value.(*sessions), true
+}
+
+func (protocol *Protocol) Started(server *chasqui.Server, addr *net.TCPAddr) {
+	sessions, _ := protocol.sessions(server)
+	sessions.users = make(map[*chasqui.Attendant]*User)
+	sessions.attendants = make(map[string][]*chasqui.Attendant)
+}
+
+func (protocol *Protocol) AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant,
+	stopType chasqui.AttendantStopType, err error) {
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		return
+	}
+	sessions.mutex.Lock()
+	user, ok := sessions.remove(attendant)
+	sessions.mutex.Unlock()
+	if ok && protocol.settings.OnLoggedOut != nil {
+		protocol.settings.OnLoggedOut(server, attendant, user)
+	}
+}
+
+// Gets the user an attendant is logged in as.
+func (protocol *Protocol) User(server *chasqui.Server, attendant *chasqui.Attendant) (*User, bool) {
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		return nil, false
+	}
+	sessions.mutex.RLock()
+	defer sessions.mutex.RUnlock()
+	user, ok := sessions.users[attendant]
+	return user, ok
+}
+
+// Gets the attendants a user is logged in from.
+func (protocol *Protocol) Attendants(server *chasqui.Server, name string) []*chasqui.Attendant {
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		return nil
+	}
+	sessions.mutex.RLock()
+	defer sessions.mutex.RUnlock()
+	return append([]*chasqui.Attendant(nil), sessions.attendants[name]...)
+}
+
+// Gets a snapshot of the logged in attendants, and their users.
+func (protocol *Protocol) LoggedIn(server *chasqui.Server) map[*chasqui.Attendant]*User {
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		return nil
+	}
+	sessions.mutex.RLock()
+	defer sessions.mutex.RUnlock()
+	loggedIn := make(map[*chasqui.Attendant]*User, len(sessions.users))
+	for attendant, user := range sessions.users {
+		loggedIn[attendant] = user
+	}
+	return loggedIn
+}
+
+// Logs an attendant out, without replying. It returns false if the
+// attendant was not logged in.
+func (protocol *Protocol) Logout(server *chasqui.Server, attendant *chasqui.Attendant) bool {
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		return false
+	}
+	sessions.mutex.Lock()
+	user, ok := sessions.remove(attendant)
+	sessions.mutex.Unlock()
+	if ok && protocol.settings.OnLoggedOut != nil {
+		protocol.settings.OnLoggedOut(server, attendant, user)
+	}
+	return ok
+}
+
+// Tells whether a user is locked out.
+func (protocol *Protocol) lockedOut(name string, now time.Time) bool {
+	if protocol.settings.MaxAttempts <= 0 {
+		return false
+	}
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	record, ok := protocol.failures[name]
+	return ok && now.Before(record.lockedUntil)
+}
+
+// Counts a failed login of a user, locking it out on too many.
+func (protocol *Protocol) failed(name string, now time.Time) {
+	if protocol.settings.MaxAttempts <= 0 {
+		return
+	}
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	stale := func(record *failures) bool {
+		return now.Sub(record.last) >= protocol.settings.LockoutDuration && !now.Before(record.lockedUntil)
+	}
+	if now.Sub(protocol.lastSweep) >= protocol.settings.LockoutDuration {
+		for key, record := range protocol.failures {
+			if stale(record) {
+				delete(protocol.failures, key)
+			}
+		}
+		protocol.lastSweep = now
+	}
+	record, ok := protocol.failures[name]
+	if !ok || stale(record) {
+		record = &failures{}
+		protocol.failures[name] = record
+	}
+	record.last = now
+	if record.count++; record.count >= protocol.settings.MaxAttempts {
+		record.count = 0
+		record.lockedUntil = now.Add(protocol.settings.LockoutDuration)
+	}
+}
+
+// Forgets the failed logins of a user.
+func (protocol *Protocol) succeeded(name string) {
+	if protocol.settings.MaxAttempts <= 0 {
+		return
+	}
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	delete(protocol.failures, name)
+}
+
+// Replies a successful result: as the RPC result, or as a command.
+func reply(attendant *chasqui.Attendant, message types.Message, command string, args types.Args) {
+	if rpcMessage, ok := protocols.AsRPC(message); ok {
+		// noinspection GoUnhandledErrorResult
+		rpcMessage.Reply(args)
+	} else {
+		// noinspection GoUnhandledErrorResult
+		attendant.Send(command, args, nil)
+	}
+}
+
+// Replies a failure: as the RPC error, or as a command.
+func fail(attendant *chasqui.Attendant, message types.Message, command string, args types.Args) {
+	if rpcMessage, ok := protocols.AsRPC(message); ok {
+		// noinspection GoUnhandledErrorResult
+		rpcMessage.Fail(command, args)
+	} else {
+		// noinspection GoUnhandledErrorResult
+		attendant.Send(command, args, nil)
+	}
+}
+
+// The login and logout arguments are validated by the funnel.
+func (protocol *Protocol) Schemas() map[string]*protocols.MessageSchema {
+	return map[string]*protocols.MessageSchema{
+		protocol.settings.Commands.Login: {
+			Args: []protocols.ArgSpec{
+				{Type: protocols.StringArg, Constraints: []protocols.ArgConstraint{protocols.MinLength(1)}},
+				{Type: protocols.StringArg},
+			},
+		},
+		protocol.settings.Commands.Logout: {},
+	}
+}
+
+func (protocol *Protocol) Handlers() protocols.MessageHandlers {
+	return protocols.MessageHandlers{
+		protocol.settings.Commands.Login:  protocol.login,
+		protocol.settings.Commands.Logout: protocol.logout,
+	}
+}
+
+// Handles the login command.
+func (protocol *Protocol) login(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+	replies := protocol.settings.Replies
+	args := message.Args()
+	name, password := args[0].(string), args[1].(string)
+	if _, ok := protocol.User(server, attendant); ok {
+		fail(attendant, message, replies.AlreadyLoggedIn, nil)
+		return
+	}
+	if protocol.lockedOut(name, time.Now()) {
+		fail(attendant, message, replies.LockedOut, types.Args{name})
+		return
+	}
+	user, err := protocol.store.Authenticate(protocols.MessageContext(server, attendant, message), name, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		protocol.failed(name, time.Now())
+		fail(attendant, message, replies.InvalidCredentials, nil)
+		return
+	} else if err != nil {
+		fail(attendant, message, replies.Error, nil)
+		return
+	}
+	protocol.succeeded(name)
+
+	sessions, ok := protocol.sessions(server)
+	if !ok {
+		fail(attendant, message, replies.Error, nil)
+		return
+	}
+	sessions.mutex.Lock()
+	if _, ok := sessions.users[attendant]; ok {
+		sessions.mutex.Unlock()
+		fail(attendant, message, replies.AlreadyLoggedIn, nil)
+		return
+	}
+	var ghosted []*chasqui.Attendant
+	if previous := sessions.attendants[user.Name]; len(previous) != 0 {
+		switch protocol.settings.DuplicateLogins {
+		case RejectNew:
+			sessions.mutex.Unlock()
+			fail(attendant, message, replies.DuplicateLogin, types.Args{user.Name})
+			return
+		case GhostPrevious:
+			ghosted = append(ghosted, previous...)
+			for _, other := range ghosted {
+				sessions.remove(other)
+			}
+		}
+	}
+	sessions.add(attendant, user)
+	sessions.mutex.Unlock()
+
+	for _, other := range ghosted {
+		// noinspection GoUnhandledErrorResult
+		other.Send(replies.Ghosted, nil, nil)
+		if protocol.settings.OnLoggedOut != nil {
+			protocol.settings.OnLoggedOut(server, other, user)
+		}
+	}
+	if protocol.settings.OnLoggedIn != nil {
+		protocol.settings.OnLoggedIn(server, attendant, user)
+	}
+	reply(attendant, message, replies.LoggedIn, types.Args{user.Name})
+}
+
+// Handles the logout command.
+func (protocol *Protocol) logout(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+	if protocol.Logout(server, attendant) {
+		reply(attendant, message, protocol.settings.Replies.LoggedOut, nil)
+	} else {
+		fail(attendant, message, protocol.settings.Replies.NotLoggedIn, nil)
+	}
+}
+
+// Makes a handler require the attendant to be logged in. Otherwise,
+// it replies LoginRequired with the command.
+func (protocol *Protocol) AuthRequired(handler protocols.MessageHandler) protocols.MessageHandler {
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		if _, ok := protocol.User(server, attendant); ok {
+			handler(server, attendant, message)
+		} else {
+			fail(attendant, message, protocol.settings.Replies.LoginRequired, types.Args{message.Command()})
+		}
+	}
+}
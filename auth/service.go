@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui-protocols"
+	"github.com/universe-10th/chasqui/types"
+)
+
+// The default reply when a command requires a login and no
+// authenticator is funneled.
+const DefaultLoginRequiredReply = "LOGIN_REQUIRED"
+
+// Authenticator is the service auth protocols provide, so other
+// protocols depend on it instead of a concrete protocol.
+type Authenticator interface {
+	User(server *chasqui.Server, attendant *chasqui.Attendant) (*User, bool)
+	Attendants(server *chasqui.Server, name string) []*chasqui.Attendant
+	LoggedIn(server *chasqui.Server) map[*chasqui.Attendant]*User
+	AuthRequired(handler protocols.MessageHandler) protocols.MessageHandler
+}
+
+// The Authenticator service, to be listed in the Requires() of
+// the protocols requiring authentication.
+var Service = protocols.ServiceOf((*Authenticator)(nil))
+
+// Gets the authenticator funneled for a running server.
+func Of(server *chasqui.Server) (Authenticator, bool) {
+	if provider, ok := protocols.Resolve(server, Service); ok {
+		authenticator, ok := provider.(Authenticator)
+		return authenticator, ok
+	}
+	return nil, false
+}
+
+// Makes a handler require the attendant to be logged in, through
+// the authenticator funneled for the server. This is the intended
+// way for other protocols to require a login, as a middleware.
+func Required(handler protocols.MessageHandler) protocols.MessageHandler {
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		if authenticator, ok := Of(server); ok {
+			authenticator.AuthRequired(handler)(server, attendant, message)
+		} else {
+			fail(attendant, message, DefaultLoginRequiredReply, types.Args{message.Command()})
+		}
+	}
+}
+
+// Gets the name of the user an attendant is logged in as, through
+// the authenticator funneled for the server. It is meant to key rate
+// limits, i.e. protocols.ByIdentity(auth.Identity).
+func Identity(server *chasqui.Server, attendant *chasqui.Attendant) (string, bool) {
+	if authenticator, ok := Of(server); ok {
+		if user, ok := authenticator.User(server, attendant); ok {
+			return user.Name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,82 @@
+// Package auth provides a ready to use authentication protocol
+// for chasqui-protocols funnels, with pluggable credential stores,
+// configurable commands, duplicate login policies, login attempt
+// lockout and a middleware other protocols can require.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+)
+
+var ErrInvalidCredentials = errors.New("invalid user name or password")
+
+// Users are the identities credential stores authenticate.
+type User struct {
+	Name  string
+	Roles []string
+}
+
+// Credential stores authenticate users by their name and
+// password. They return ErrInvalidCredentials (or an error
+// wrapping it) when the name or password are wrong, and other
+// errors when the store itself fails. The context is the one
+// of the LOGIN message handling (see protocols.MessageContext),
+// so slow stores can honor it.
+type CredentialStore interface {
+	Authenticate(ctx context.Context, name, password string) (*User, error)
+}
+
+// StoreFunc adapts a function (e.g. one querying a database or
+// an external service) to a CredentialStore.
+type StoreFunc func(ctx context.Context, name, password string) (*User, error)
+
+func (function StoreFunc) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	return function(ctx, name, password)
+}
+
+// An in-memory user entry.
+type memoryEntry struct {
+	digest [sha256.Size]byte
+	roles  []string
+}
+
+// MemoryStore keeps the users in memory. It is meant for tests,
+// samples and small deployments, and is safe for concurrent use.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+// Creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry)}
+}
+
+// Adds a user, or replaces it if it already exists.
+func (store *MemoryStore) Set(name, password string, roles ...string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entries[name] = memoryEntry{sha256.Sum256([]byte(password)), append([]string(nil), roles...)}
+}
+
+// Removes a user, if it exists.
+func (store *MemoryStore) Remove(name string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.entries, name)
+}
+
+func (store *MemoryStore) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	store.mutex.RLock()
+	entry, ok := store.entries[name]
+	store.mutex.RUnlock()
+	digest := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(digest[:], entry.digest[:]) != 1 || !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &User{Name: name, Roles: append([]string(nil), entry.roles...)}, nil
+}
@@ -0,0 +1,66 @@
+package protocols
+
+// Marks a funnel event as running. Events run concurrently among
+// them, but wait while there are changes of the composition to
+// apply, so the changes are not starved by a busy funnel.
+func (funnel *ProtocolsFunnel) beginEvent() {
+	funnel.gateMutex.Lock()
+	defer funnel.gateMutex.Unlock()
+	for funnel.applyingChanges || len(funnel.pendingChanges) != 0 {
+		funnel.gateCond.Wait()
+	}
+	funnel.runningEvents++
+}
+
+// Marks a funnel event as finished, applying the pending changes
+// if it was the last running one.
+func (funnel *ProtocolsFunnel) endEvent() {
+	funnel.gateMutex.Lock()
+	defer funnel.gateMutex.Unlock()
+	funnel.runningEvents--
+	funnel.applyPendingChanges()
+}
+
+// Applies the pending changes, one at a time, if no event is
+// running and no other goroutine is applying them already. The
+// gate mutex must be held, and it is released while applying
+// each change, so the lifecycle callbacks run by a change may
+// request further changes (which are queued, and applied right
+// after it).
+func (funnel *ProtocolsFunnel) applyPendingChanges() {
+	if funnel.runningEvents != 0 || funnel.applyingChanges {
+		return
+	}
+	funnel.applyingChanges = true
+	for len(funnel.pendingChanges) != 0 {
+		apply := funnel.pendingChanges[0]
+		funnel.pendingChanges = funnel.pendingChanges[1:]
+		funnel.gateMutex.Unlock()
+		apply()
+		funnel.gateMutex.Lock()
+	}
+	funnel.applyingChanges = false
+	funnel.gateCond.Broadcast()
+}
+
+// Changes the composition of the funnel. The preparation gets
+// the composition every previous change leads to, and returns
+// the next one and how to apply it to the running servers and
+// attendants. It fails without changing anything if the
+// preparation does. The change is applied right away, or, if
+// funnel events are running (e.g. this method is invoked from a
+// lifecycle callback) or other changes are being applied, queued
+// and applied as soon as they end (handlers do not count as
+// events, so they may request changes too).
+func (funnel *ProtocolsFunnel) change(prepare func(current *composition) (*composition, func(), error)) error {
+	funnel.gateMutex.Lock()
+	defer funnel.gateMutex.Unlock()
+	next, apply, err := prepare(funnel.target)
+	if err != nil {
+		return err
+	}
+	funnel.target = next
+	funnel.pendingChanges = append(funnel.pendingChanges, apply)
+	funnel.applyPendingChanges()
+	return nil
+}
@@ -0,0 +1,97 @@
+package protocols
+
+import (
+	"context"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+)
+
+// ContextHandler is a context-aware MessageHandler. The context
+// belongs to the attendant, and is cancelled when it stops (or
+// when its server stops), so in-flight work (e.g. queries to a
+// database) is cancelled automatically.
+type ContextHandler func(ctx context.Context, server *chasqui.Server, attendant *chasqui.Attendant, message types.Message)
+
+// A context which is already cancelled, used for the servers and
+// attendants which are not running (anymore) in a funnel.
+var doneContext = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// Creates the context of a server or attendant, deriving it
+// from the given parent.
+func newRecordContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithCancel(parent)
+}
+
+// Option to set the context all the server contexts derive from.
+// Cancelling it cancels the contexts of all the servers and their
+// attendants. By default, context.Background() is used.
+func WithBaseContext(ctx context.Context) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.baseContext = ctx
+	}
+}
+
+// Gets the context of a server started in this funnel. It is
+// cancelled when the server stops, right before the protocols
+// are stopped. If the server is not running in this funnel, an
+// already cancelled context is returned.
+func (funnel *ProtocolsFunnel) ServerContext(server *chasqui.Server) context.Context {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	if record, ok := funnel.servers[server]; ok && record.ctx != nil {
+		return record.ctx
+	}
+	return doneContext
+}
+
+// Gets the context of an attendant started in this funnel. It
+// derives from the context of its server, and is cancelled when
+// the attendant stops, right before the protocols are stopped.
+// If the attendant is not running in this funnel, an already
+// cancelled context is returned.
+func (funnel *ProtocolsFunnel) AttendantContext(attendant *chasqui.Attendant) context.Context {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	if record, ok := funnel.attendants[attendant]; ok && record.ctx != nil {
+		return record.ctx
+	}
+	return doneContext
+}
+
+// Gets the context of a running server, through the funnel
+// serving it. Protocols use this function in their lifecycle
+// callbacks and handlers.
+func ServerContext(server *chasqui.Server) context.Context {
+	if funnel, ok := ServingFunnel(server); ok {
+		return funnel.ServerContext(server)
+	}
+	return doneContext
+}
+
+// Gets the context of a running attendant, through the funnel
+// serving its server. Protocols use this function in their
+// lifecycle callbacks and handlers.
+func AttendantContext(server *chasqui.Server, attendant *chasqui.Attendant) context.Context {
+	if funnel, ok := ServingFunnel(server); ok {
+		return funnel.AttendantContext(attendant)
+	}
+	return doneContext
+}
+
+// Adapts a context-aware handler to a MessageHandler, which
+// gets the context of the handling on each message (see
+// MessageContext).
+func Contextual(handler ContextHandler) MessageHandler {
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		handler(MessageContext(server, attendant, message), server, attendant, message)
+	}
+}
+
+// Gets the context of the handling of this call.
+func (call *Call) Context() context.Context {
+	return MessageContext(call.Server, call.Attendant, call.Message)
+}
@@ -1,42 +1,227 @@
 package protocols
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var ErrCircularDependencies = errors.New("a circular dependency was detected among protocols")
+var ErrWrapperConflict = errors.New("the same protocol was wrapped in two different ways")
 
-func traverseDependency(dependency Protocol, traversed Protocols, collected map[Protocol]int) error {
-	if _, ok := traversed[dependency]; ok {
-		return ErrCircularDependencies
-	} else if _, ok := collected[dependency]; ok {
+// Describes a circular dependency. The chain starts and
+// ends with the same protocol, and each protocol depends
+// on the next one. It satisfies errors.Is against the
+// ErrCircularDependencies sentinel.
+type CycleError struct {
+	Chain []Protocol
+}
+
+func (cycleError *CycleError) Error() string {
+	names := make([]string, len(cycleError.Chain))
+	for index, protocol := range cycleError.Chain {
+		names[index] = ProtocolName(protocol)
+	}
+	return ErrCircularDependencies.Error() + ": " + strings.Join(names, " -> ")
+}
+
+func (cycleError *CycleError) Is(target error) bool {
+	return target == ErrCircularDependencies
+}
+
+// Protocols decorating other protocols (e.g. the namespaced
+// protocols) implement this interface, so the decorated one
+// can be retrieved. For the purpose of dependencies, both
+// the decorator and the decorated protocol are the same.
+type ProtocolWrapper interface {
+	Protocol
+	Unwrap() Protocol
+}
+
+// Gets the innermost protocol of a (perhaps) decorated one.
+// That one is the identity of the protocol when resolving
+// the dependencies.
+func identityOf(protocol Protocol) Protocol {
+	for {
+		if wrapper, ok := protocol.(ProtocolWrapper); ok {
+			protocol = wrapper.Unwrap()
+		} else {
+			return protocol
+		}
+	}
+}
+
+// Chooses which instance will be used for an already collected
+// protocol identity. Wrappers are preferred over the raw protocol,
+// but two different wrappers are not allowed for the same identity.
+func preferInstance(instances map[Protocol]Protocol, identity, dependency Protocol) error {
+	current := instances[identity]
+	if current == dependency || dependency == identity {
+		return nil
+	} else if current == identity {
+		instances[identity] = dependency
 		return nil
+	} else {
+		return ErrWrapperConflict
+	}
+}
+
+// Builds the cycle error from the current traversal path, which
+// contains the given identity somewhere.
+func newCycleError(path []Protocol, identity Protocol) *CycleError {
+	for index, protocol := range path {
+		if identityOf(protocol) == identity {
+			chain := make([]Protocol, len(path)-index, len(path)-index+1)
+			copy(chain, path[index:])
+			return &CycleError{append(chain, protocol)}
+		}
+	}
+	return &CycleError{[]Protocol{identity}}
+}
+
+// Gets the protocol standing for another one: its substitute,
+// if it was replaced, or itself.
+func substituteOf(protocol Protocol, substitutes map[Protocol]Protocol) Protocol {
+	if substitute, ok := substitutes[identityOf(protocol)]; ok {
+		return substitute
+	}
+	return protocol
+}
+
+// Protocols may optionally implement this interface to declare
+// optional dependencies. Those are not funneled because of being
+// declared here, but if some other part of the composition does
+// funnel them, they will be started before the dependent protocol
+// (and stopped after it). Use Included to check, at runtime,
+// whether they are present.
+type OptionalDependent interface {
+	OptionalDependencies() Protocols
+}
+
+// Gets the optional dependencies of a protocol, if any.
+func optionalDependenciesOf(protocol Protocol) Protocols {
+	if dependent, ok := protocol.(OptionalDependent); ok {
+		return dependent.OptionalDependencies()
+	}
+	return nil
+}
+
+// Holds the state of a single flattening traversal.
+type flattener struct {
+	substitutes map[Protocol]Protocol
+	included    Protocols
+	services    *serviceIndex
+	traversed   Protocols
+	path        []Protocol
+	collected   map[Protocol]int
+	instances   map[Protocol]Protocol
+}
+
+func (flattener *flattener) traverse(dependency Protocol) error {
+	dependency = substituteOf(dependency, flattener.substitutes)
+	identity := identityOf(dependency)
+	if _, ok := flattener.traversed[identity]; ok {
+		return newCycleError(flattener.path, identity)
+	} else if _, ok := flattener.collected[identity]; ok {
+		return preferInstance(flattener.instances, identity, dependency)
 	}
 
-	traversed[dependency] = true
-	defer delete(traversed, dependency)
+	flattener.traversed[identity] = true
+	flattener.path = append(flattener.path, dependency)
+	defer func() {
+		delete(flattener.traversed, identity)
+		flattener.path = flattener.path[:len(flattener.path)-1]
+	}()
 
-	for dependency := range dependency.Dependencies() {
-		if err := traverseDependency(dependency, traversed, collected); err != nil {
+	ordered, remaining := splitDependenciesOf(dependency)
+	if err := flattener.traverseAll(dependency, ordered, false); err != nil {
+		return err
+	} else if err := flattener.traverseAll(dependency, remaining, true); err != nil {
+		return err
+	}
+	if flattener.services != nil {
+		providers := sortProtocols(flattener.services.dependencies[identity])
+		if err := flattener.traverseAll(dependency, providers, true); err != nil {
 			return err
 		}
 	}
-	collected[dependency] = len(collected)
+	present := make(Protocols)
+	for optional := range optionalDependenciesOf(dependency) {
+		if flattener.included[identityOf(substituteOf(optional, flattener.substitutes))] {
+			present[optional] = true
+		}
+	}
+	if err := flattener.traverseAll(dependency, sortProtocols(present), true); err != nil {
+		return err
+	}
+	flattener.collected[identity] = len(flattener.collected)
+	flattener.instances[identity] = dependency
 	return nil
 }
 
-func flatten(dependencies []Protocol) ([]Protocol, error) {
-	traversed := make(Protocols)
-	collected := make(map[Protocol]int)
+// Traverses some dependencies of a protocol, in order. Sorted
+// dependencies are checked to be in a stable order first.
+func (flattener *flattener) traverseAll(dependent Protocol, dependencies []Protocol, sorted bool) error {
+	if sorted {
+		if err := checkOrder(dependent, dependencies); err != nil {
+			return err
+		}
+	}
+	for _, dependency := range dependencies {
+		if err := flattener.traverse(dependency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// Traverses all the dependencies, and returns them in startup
+// order. Only the optional dependencies already included, and
+// the resolved services (if any), are traversed.
+func (flattener *flattener) run(dependencies []Protocol) ([]Protocol, error) {
 	for _, dependency := range dependencies {
-		if err := traverseDependency(dependency, traversed, collected); err != nil {
+		if err := flattener.traverse(dependency); err != nil {
 			return nil, err
 		}
 	}
 
-	count := len(collected)
-	flat := make([]Protocol, count)
-	for protocol, index := range collected {
-		flat[index] = protocol
+	flat := make([]Protocol, len(flattener.collected))
+	for identity, index := range flattener.collected {
+		flat[index] = flattener.instances[identity]
 	}
 	return flat, nil
 }
+
+func newFlattener(substitutes map[Protocol]Protocol, included Protocols, services *serviceIndex) *flattener {
+	return &flattener{
+		substitutes: substitutes,
+		included:    included,
+		services:    services,
+		traversed:   make(Protocols),
+		collected:   make(map[Protocol]int),
+		instances:   make(map[Protocol]Protocol),
+	}
+}
+
+// Flattens the dependencies in startup order. Replaced protocols
+// are flattened as their substitutes. The first pass collects the
+// funneled protocols, then the services are resolved among them,
+// and the second pass orders them considering also the optional
+// dependencies and the services providers among them.
+func flatten(dependencies []Protocol, substitutes map[Protocol]Protocol) ([]Protocol, *serviceIndex, error) {
+	flat, err := newFlattener(substitutes, nil, nil).run(dependencies)
+	if err != nil {
+		return nil, nil, err
+	}
+	included := make(Protocols)
+	for _, protocol := range flat {
+		included[identityOf(protocol)] = true
+	}
+	services, err := resolveServices(flat)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flat, err = newFlattener(substitutes, included, services).run(dependencies); err != nil {
+		return nil, nil, err
+	}
+	return flat, services, nil
+}
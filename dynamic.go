@@ -0,0 +1,222 @@
+package protocols
+
+import (
+	"errors"
+	"github.com/universe-10th/chasqui"
+	"strings"
+)
+
+var ErrProtocolNotFound = errors.New("the protocol is not funneled")
+var ErrProtocolAlreadyAdded = errors.New("the protocol is already funneled")
+var ErrProtocolHasDependents = errors.New("the protocol has dependents")
+var ErrProtocolRemoved = errors.New("the protocol was removed from the funnel")
+
+// Describes a protocol that cannot be removed since other
+// funneled protocols depend on it. It satisfies errors.Is
+// against the ErrProtocolHasDependents sentinel.
+type DependentsError struct {
+	Protocol   Protocol
+	Dependents []Protocol
+}
+
+func (dependentsError *DependentsError) Error() string {
+	names := make([]string, len(dependentsError.Dependents))
+	for index, dependent := range dependentsError.Dependents {
+		names[index] = ProtocolName(dependent)
+	}
+	return ErrProtocolHasDependents.Error() + ": " + ProtocolName(dependentsError.Protocol) +
+		" is required by " + strings.Join(names, ", ")
+}
+
+func (dependentsError *DependentsError) Is(target error) bool {
+	return target == ErrProtocolHasDependents
+}
+
+// Gets the protocols of a list (by identity) which are not in
+// the other list, keeping their order.
+func missingFrom(protocols []Protocol, others []Protocol) []Protocol {
+	present := make(Protocols)
+	for _, other := range others {
+		present[identityOf(other)] = true
+	}
+	var missing []Protocol
+	for _, protocol := range protocols {
+		if !present[identityOf(protocol)] {
+			missing = append(missing, protocol)
+		}
+	}
+	return missing
+}
+
+// Tells whether a funneled protocol depends on the given identity,
+// considering the replaced protocols and the resolved services.
+func dependsOn(candidate Protocol, identity Protocol, composition *composition) bool {
+	for provider := range composition.services.dependencies[identityOf(candidate)] {
+		if identityOf(provider) == identity {
+			return true
+		}
+	}
+	for _, dependency := range dependenciesOf(candidate) {
+		if identityOf(substituteOf(dependency, composition.substitutes)) == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the funneled protocols which depend on the given one.
+func dependentsOf(protocol Protocol, composition *composition) []Protocol {
+	identity := identityOf(protocol)
+	var dependents []Protocol
+	for _, candidate := range composition.flattened {
+		if dependsOn(candidate, identity, composition) {
+			dependents = append(dependents, candidate)
+		}
+	}
+	return dependents
+}
+
+// Adds a protocol (and its not yet funneled dependencies) to a
+// live funnel. The new protocols are started, in startup order,
+// for the already running servers and attendants, and then their
+// handlers become available. A panic while starting vetoes the
+// server or attendant as usual. The started protocols are kept in
+// the new startup order, so the new protocols are stopped at
+// their place in the new teardown order (e.g. after the running
+// protocols optionally depending on them). This method may be
+// invoked from anywhere: if lifecycle events are running (e.g.
+// from a lifecycle callback), the change is queued and applied
+// right after them, although errors are still returned.
+func (funnel *ProtocolsFunnel) AddProtocol(protocol Protocol) error {
+	return funnel.change(func(current *composition) (*composition, func(), error) {
+		for _, root := range current.roots {
+			if identityOf(root) == identityOf(protocol) {
+				return nil, nil, ErrProtocolAlreadyAdded
+			}
+		}
+		roots := append(append([]Protocol(nil), current.roots...), protocol)
+		next, err := funnel.compose(roots, current.substitutes)
+		if err != nil {
+			return nil, nil, err
+		}
+		added := missingFrom(next.flattened, current.flattened)
+		return next, func() {
+			funnel.startAdded(next, added)
+		}, nil
+	})
+}
+
+// Starts the added protocols for the running servers and
+// attendants, and then publishes their handlers.
+func (funnel *ProtocolsFunnel) startAdded(next *composition, added []Protocol) {
+	// The state keys of the new protocols must be known while
+	// starting them.
+	funnel.composition = next
+	for server, record := range funnel.servers {
+		if !record.vetoed {
+			funnel.startServer(server, record, added)
+		}
+		record.started = reorder(record.started, next.flattened, nil, nil)
+	}
+	for attendant, record := range funnel.attendants {
+		if serverRecord, ok := funnel.servers[record.server]; !record.vetoed && ok && !serverRecord.vetoed {
+			funnel.startAttendant(record.server, attendant, record, added)
+		}
+		record.started = reorder(record.started, next.flattened, nil, nil)
+	}
+	funnel.setComposition(next)
+}
+
+// Removes a protocol from a live funnel, also removing the
+// dependencies no other protocol needs anymore. It fails if
+// other protocols depend on it. The handlers of the removed
+// protocols become unavailable, and then they are stopped, in
+// teardown order, for the running attendants and servers (the
+// attendants get ErrProtocolRemoved as the stop error). This
+// method may be invoked from anywhere, as AddProtocol.
+func (funnel *ProtocolsFunnel) RemoveProtocol(protocol Protocol) error {
+	return funnel.change(func(current *composition) (*composition, func(), error) {
+		var roots []Protocol
+		found := false
+		for _, root := range current.roots {
+			if identityOf(root) == identityOf(protocol) {
+				found = true
+			} else {
+				roots = append(roots, root)
+			}
+		}
+		if dependents := dependentsOf(protocol, current); len(dependents) != 0 {
+			return nil, nil, &DependentsError{protocol, dependents}
+		} else if !found {
+			return nil, nil, ErrProtocolNotFound
+		}
+		substitutes := make(map[Protocol]Protocol)
+		for replaced, substitute := range current.substitutes {
+			if identityOf(substitute) != identityOf(protocol) {
+				substitutes[replaced] = substitute
+			}
+		}
+		next, err := funnel.compose(roots, substitutes)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed := make(Protocols)
+		for _, protocol := range missingFrom(current.flattened, next.flattened) {
+			removed[protocol] = true
+		}
+		return next, func() {
+			funnel.stopRemoved(next, removed)
+		}, nil
+	})
+}
+
+// Unpublishes the handlers of the removed protocols, and then
+// stops them for the running attendants and servers.
+func (funnel *ProtocolsFunnel) stopRemoved(next *composition, removed Protocols) {
+	// The state keys of the removed protocols must be known while
+	// stopping them.
+	funnel.published.Store(next)
+	for attendant, record := range funnel.attendants {
+		record.started = funnel.stopAttendantProtocols(record.server, attendant, record.started, removed)
+	}
+	for server, record := range funnel.servers {
+		record.started = funnel.stopServerProtocols(server, record.started, removed)
+	}
+	funnel.setComposition(next)
+}
+
+// Stops, in teardown order, the removed protocols for an attendant,
+// and returns the protocols that remain started.
+func (funnel *ProtocolsFunnel) stopAttendantProtocols(server *chasqui.Server, attendant *chasqui.Attendant,
+	started []Protocol, removed Protocols) []Protocol {
+	for index := len(started) - 1; index >= 0; index-- {
+		if removed[started[index]] {
+			funnel.safeAttendantStoppedCallback(server, attendant, chasqui.AttendantLocalStop, ErrProtocolRemoved,
+				started[index])
+		}
+	}
+	return withoutRemoved(started, removed)
+}
+
+// Stops, in teardown order, the removed protocols for a server,
+// and returns the protocols that remain started.
+func (funnel *ProtocolsFunnel) stopServerProtocols(server *chasqui.Server, started []Protocol,
+	removed Protocols) []Protocol {
+	for index := len(started) - 1; index >= 0; index-- {
+		if removed[started[index]] {
+			funnel.safeStoppedCallback(server, started[index])
+		}
+	}
+	return withoutRemoved(started, removed)
+}
+
+// Filters the removed protocols out of a list.
+func withoutRemoved(started []Protocol, removed Protocols) []Protocol {
+	var remaining []Protocol
+	for _, protocol := range started {
+		if !removed[protocol] {
+			remaining = append(remaining, protocol)
+		}
+	}
+	return remaining
+}
@@ -1,69 +1,246 @@
 package protocols
 
 import (
+	"context"
 	"errors"
 	"github.com/universe-10th/chasqui"
 	"github.com/universe-10th/chasqui/types"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrNoProtocols = errors.New("no protocols specified")
+var ErrServerStopped = errors.New("the server stopped while the attendant was running")
+
+// The protocols being funneled at a given time, and
+// everything derived from them. Compositions are not
+// modified: adding or removing protocols creates a
+// new one.
+type composition struct {
+	roots           []Protocol
+	substitutes     map[Protocol]Protocol
+	flattened       []Protocol
+	included        Protocols
+	levels          map[Protocol]int
+	services        *serviceIndex
+	handlers        MessageHandlers
+	handlerOwners   map[string]Protocol
+	stateKeys       map[Protocol][]*StateKey
+	serverStateKeys map[Protocol][]*ServerStateKey
+}
+
+// Tracks the protocols started for a server, in startup
+// order, and whether the server was vetoed.
+type serverRecord struct {
+	addr    *net.TCPAddr
+	started []Protocol
+	vetoed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Tracks the protocols started for an attendant, in startup
+// order, and whether the attendant was vetoed.
+type attendantRecord struct {
+	server  *chasqui.Server
+	started []Protocol
+	vetoed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
 
 // Funnels several protocols simultaneously for the
 // managed server & attendants. It MAY handle several
 // servers at once, if the protocols are carefully
-// designed.
+// designed. Since each server runs its funnel loop in
+// its own goroutine, the lifecycle bookkeeping is guarded
+// by a mutex, while the lifecycle events and the changes
+// to the composition (e.g. adding a protocol) are gated:
+// events run concurrently, and changes run alone (see
+// change). Messages are handled by the published
+// composition, without passing through the gate.
 type ProtocolsFunnel struct {
-	flattened               []Protocol
-	handlers                MessageHandlers
-	serverLoadProgress      map[*chasqui.Server]int
-	attendantLoadProgress   map[*chasqui.Attendant]int
+	gateMutex               sync.Mutex
+	gateCond                *sync.Cond
+	runningEvents           int
+	applyingChanges         bool
+	pendingChanges          []func()
+	target                  *composition
+	composition             *composition
+	published               atomic.Value
+	progressMutex           sync.Mutex
+	servers                 map[*chasqui.Server]*serverRecord
+	attendants              map[*chasqui.Attendant]*attendantRecord
 	onStartedPanic          func(*chasqui.Server, *net.TCPAddr, Protocol, interface{})
 	onAttendantStartedPanic func(*chasqui.Server, *chasqui.Attendant, Protocol, interface{})
+	onStartedVeto           func(*chasqui.Server, *net.TCPAddr, Protocol, error)
+	onAttendantStartedVeto  func(*chasqui.Server, *chasqui.Attendant, Protocol, error)
 	onAcceptFailed          func(*chasqui.Server, error)
 	onMessageUnknown        MessageHandler
 	onMessagePanic          MessagePanicHandler
+	onMessageInvalid        MessageInvalidHandler
 	onMessageThrottled      func(*chasqui.Server, *chasqui.Attendant, types.Message, time.Time, time.Duration)
+	onMessageRejected       MessageHandler
+	onMessageTimeout        func(*chasqui.Server, *chasqui.Attendant, types.Message, time.Duration)
+	onRateLimited           func(*chasqui.Server, *chasqui.Attendant, types.Message, string)
 	onAttendantStoppedPanic func(*chasqui.Server, *chasqui.Attendant, chasqui.AttendantStopType, error, Protocol, interface{})
 	onStoppedPanic          func(*chasqui.Server, Protocol, interface{})
+	middlewares             []MessageMiddleware
+	rpc                     *RPCSettings
+	logger                  Logger
+	parallelStartup         bool
+	baseContext             context.Context
+	handlerTimeout          time.Duration
 }
 
-// Attempts to start all the protocols with respect to a server.
-// Each protocol must attempt to start, or panic an error. "Starting
-// with respect to a server" must have nothing to do with "starting
-// with respect to another server", so the interactions must be thought
-// as completely isolated among servers.
-func (funnel *ProtocolsFunnel) Started(server *chasqui.Server, addr *net.TCPAddr) {
+// Gets the record of a server, creating it if absent.
+func (funnel *ProtocolsFunnel) serverRecord(server *chasqui.Server, addr *net.TCPAddr) *serverRecord {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	record, ok := funnel.servers[server]
+	if !ok {
+		record = &serverRecord{addr: addr}
+		record.ctx, record.cancel = newRecordContext(funnel.baseContext)
+		funnel.servers[server] = record
+	}
+	return record
+}
+
+// Forgets the record of a server, returning it. If no record
+// is tracked, all the protocols are considered started.
+func (funnel *ProtocolsFunnel) popServerRecord(server *chasqui.Server) *serverRecord {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	record, ok := funnel.servers[server]
+	if !ok {
+		record = &serverRecord{started: funnel.composition.flattened}
+	}
+	delete(funnel.servers, server)
+	return record
+}
+
+// Gets the record of an attendant, creating it if absent.
+func (funnel *ProtocolsFunnel) attendantRecord(server *chasqui.Server, attendant *chasqui.Attendant) *attendantRecord {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	record, ok := funnel.attendants[attendant]
+	if !ok {
+		record = &attendantRecord{server: server}
+		parent := funnel.baseContext
+		if serverRecord, ok := funnel.servers[server]; ok {
+			parent = serverRecord.ctx
+		}
+		record.ctx, record.cancel = newRecordContext(parent)
+		funnel.attendants[attendant] = record
+	}
+	return record
+}
+
+// Forgets the record of an attendant, returning it. If no
+// record is tracked, all the protocols are considered started.
+func (funnel *ProtocolsFunnel) popAttendantRecord(attendant *chasqui.Attendant) *attendantRecord {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	record, ok := funnel.attendants[attendant]
+	if !ok {
+		record = &attendantRecord{started: funnel.composition.flattened}
+	}
+	delete(funnel.attendants, attendant)
+	return record
+}
+
+// Forgets the records of the attendants of a server, returning
+// them.
+func (funnel *ProtocolsFunnel) popServerAttendantRecords(server *chasqui.Server) map[*chasqui.Attendant]*attendantRecord {
+	funnel.progressMutex.Lock()
+	defer funnel.progressMutex.Unlock()
+	records := make(map[*chasqui.Attendant]*attendantRecord)
+	for attendant, record := range funnel.attendants {
+		if record.server == server {
+			records[attendant] = record
+			delete(funnel.attendants, attendant)
+		}
+	}
+	return records
+}
+
+// Reports a protocol that panicked while starting for a server,
+// and vetoes the server. The server must be told to stop later.
+func (funnel *ProtocolsFunnel) serverStartPanicked(server *chasqui.Server, record *serverRecord, protocol Protocol,
+	recovered interface{}, stack []byte) {
+	funnel.composition.clearServerState(server, protocol)
+	record.vetoed = true
+	funnel.logger.Error("protocol panicked while starting for server", "server", server,
+		"protocol", ProtocolName(protocol), "panic", recovered, "stack", string(stack))
+	if funnel.onStartedPanic != nil {
+		funnel.onStartedPanic(server, record.addr, protocol, recovered)
+	}
+}
+
+// Tells that a protocol started for a server.
+func (funnel *ProtocolsFunnel) serverStartSucceeded(server *chasqui.Server, record *serverRecord, protocol Protocol) {
+	record.started = append(record.started, protocol)
+	funnel.logger.Debug("protocol started for server", "server", server, "addr", record.addr,
+		"protocol", ProtocolName(protocol))
+}
+
+// Starts the given protocols, in order, for a server. If one
+// of them panics or vetoes, the server is vetoed and told to
+// stop.
+func (funnel *ProtocolsFunnel) startServer(server *chasqui.Server, record *serverRecord, protocols []Protocol) {
+	if funnel.parallelStartup {
+		funnel.startServerInParallel(server, record, protocols)
+		return
+	}
 	var protocol Protocol
 	defer func() {
 		if recovered := recover(); recovered != nil {
-			if funnel.onStartedPanic != nil {
-				funnel.onStartedPanic(server, addr, protocol, recovered)
-			}
+			funnel.serverStartPanicked(server, record, protocol, recovered, debug.Stack())
 			// noinspection GoUnhandledErrorResult
 			server.Stop()
 		}
 	}()
-	for _, protocol = range funnel.flattened {
-		protocol.Started(server, addr)
-		funnel.serverLoadProgress[server] = funnel.serverLoadProgress[server] + 1
+	for _, protocol = range protocols {
+		funnel.composition.allocateServerState(server, protocol)
+		if err := startedOf(protocol, server, record.addr); err != nil {
+			funnel.serverStartVetoed(server, record, protocol, err)
+			// noinspection GoUnhandledErrorResult
+			server.Stop()
+			return
+		}
+		funnel.serverStartSucceeded(server, record, protocol)
 	}
-	// If no panic occurred, we don't need to keep the server load progress
-	// anymore.
-	delete(funnel.serverLoadProgress, server)
+}
+
+// Attempts to start all the protocols with respect to a server.
+// Each protocol must attempt to start, or panic an error. "Starting
+// with respect to a server" must have nothing to do with "starting
+// with respect to another server", so the interactions must be thought
+// as completely isolated among servers.
+func (funnel *ProtocolsFunnel) Started(server *chasqui.Server, addr *net.TCPAddr) {
+	funnel.beginEvent()
+	defer funnel.endEvent()
+	registerServingFunnel(server, funnel)
+	funnel.startServer(server, funnel.serverRecord(server, addr), funnel.composition.flattened)
 }
 
 // Executes tha stopped callback safely.
 func (funnel *ProtocolsFunnel) safeStoppedCallback(server *chasqui.Server, protocol Protocol) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
+			funnel.logger.Error("protocol panicked while stopping for server", "server", server,
+				"protocol", ProtocolName(protocol), "panic", recovered, "stack", string(debug.Stack()))
 			if funnel.onStoppedPanic != nil {
 				funnel.onStoppedPanic(server, protocol, recovered)
 			}
 		}
 	}()
-	protocol.Stopped(server)
+	defer funnel.composition.clearServerState(server, protocol)
+	stoppedOf(protocol, server)
+	funnel.logger.Debug("protocol stopped for server", "server", server, "protocol", ProtocolName(protocol))
 }
 
 // Attempts to "stop" each protocol's relationship with a server
@@ -71,58 +248,110 @@ func (funnel *ProtocolsFunnel) safeStoppedCallback(server *chasqui.Server, proto
 // all the protocols that started with it. Stop callbacks may panic,
 // and that will be reported, but they shouldn't. Each stop callback
 // will be recovered from panics independently.
+// The context of the server is cancelled before that. Chasqui
+// tells no more events of a server after it stops, so the still
+// running attendants of the server are stopped first (with
+// ErrServerStopped as the stop error).
 func (funnel *ProtocolsFunnel) Stopped(server *chasqui.Server) {
-	var count int
-	var ok bool
-	if count, ok = funnel.serverLoadProgress[server]; !ok {
-		count = len(funnel.flattened)
+	funnel.beginEvent()
+	defer funnel.endEvent()
+	record := funnel.popServerRecord(server)
+	if record.cancel != nil {
+		record.cancel()
+	}
+	for attendant, attendantRecord := range funnel.popServerAttendantRecords(server) {
+		funnel.stopAttendant(server, attendant, attendantRecord, chasqui.AttendantLocalStop, ErrServerStopped)
 	}
-	for count > 0 {
-		index := count - 1
-		funnel.safeStoppedCallback(server, funnel.flattened[index])
-		count = index
+	started := record.started
+	for index := len(started) - 1; index >= 0; index-- {
+		funnel.safeStoppedCallback(server, started[index])
 	}
-	delete(funnel.serverLoadProgress, server)
+	unregisterServingFunnel(server)
 }
 
 // Processes errors related to connections not being accepted.
 func (funnel *ProtocolsFunnel) AcceptFailed(server *chasqui.Server, err error) {
+	funnel.logger.Error("server failed to accept a connection", "server", server, "error", err)
 	if funnel.onAcceptFailed != nil {
 		funnel.onAcceptFailed(server, err)
 	}
 }
 
-func (funnel *ProtocolsFunnel) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+// Reports a protocol that panicked while starting for an attendant,
+// and vetoes the attendant. The attendant must be told to stop later.
+func (funnel *ProtocolsFunnel) attendantStartPanicked(server *chasqui.Server, attendant *chasqui.Attendant,
+	record *attendantRecord, protocol Protocol, recovered interface{}, stack []byte) {
+	funnel.composition.clearAttendantState(attendant, protocol)
+	record.vetoed = true
+	funnel.logger.Error("protocol panicked while starting for attendant", "server", server,
+		"attendant", attendant, "protocol", ProtocolName(protocol), "panic", recovered,
+		"stack", string(stack))
+	if funnel.onAttendantStartedPanic != nil {
+		funnel.onAttendantStartedPanic(server, attendant, protocol, recovered)
+	}
+}
+
+// Tells that a protocol started for an attendant.
+func (funnel *ProtocolsFunnel) attendantStartSucceeded(server *chasqui.Server, attendant *chasqui.Attendant,
+	record *attendantRecord, protocol Protocol) {
+	record.started = append(record.started, protocol)
+	funnel.logger.Debug("protocol started for attendant", "server", server, "attendant", attendant,
+		"protocol", ProtocolName(protocol))
+}
+
+// Starts the given protocols, in order, for an attendant. If one
+// of them panics or vetoes, the attendant is vetoed and told to
+// stop.
+func (funnel *ProtocolsFunnel) startAttendant(server *chasqui.Server, attendant *chasqui.Attendant, record *attendantRecord,
+	protocols []Protocol) {
+	if funnel.parallelStartup {
+		funnel.startAttendantInParallel(server, attendant, record, protocols)
+		return
+	}
 	var protocol Protocol
 	defer func() {
 		if recovered := recover(); recovered != nil {
-			if funnel.onAttendantStartedPanic != nil {
-				funnel.onAttendantStartedPanic(server, attendant, protocol, recovered)
-			}
+			funnel.attendantStartPanicked(server, attendant, record, protocol, recovered, debug.Stack())
 			// noinspection GoUnhandledErrorResult
 			attendant.Stop()
 		}
 	}()
-	for _, protocol = range funnel.flattened {
-		protocol.AttendantStarted(server, attendant)
-		funnel.attendantLoadProgress[attendant] = funnel.attendantLoadProgress[attendant] + 1
+	for _, protocol = range protocols {
+		funnel.composition.allocateAttendantState(attendant, protocol)
+		if err := attendantStartedOf(protocol, server, attendant); err != nil {
+			funnel.attendantStartVetoed(server, attendant, record, protocol, err)
+			// noinspection GoUnhandledErrorResult
+			attendant.Stop()
+			return
+		}
+		funnel.attendantStartSucceeded(server, attendant, record, protocol)
 	}
-	// If no panic occurred, we don't need to keep the attendant load progress
-	// anymore.
-	delete(funnel.attendantLoadProgress, attendant)
+}
+
+func (funnel *ProtocolsFunnel) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+	funnel.beginEvent()
+	defer funnel.endEvent()
+	funnel.startAttendant(server, attendant, funnel.attendantRecord(server, attendant), funnel.composition.flattened)
 }
 
 // This event is strictly bypassed to a callback.
 func (funnel *ProtocolsFunnel) MessageThrottled(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
 	instant time.Time, lapse time.Duration) {
+	funnel.logger.Info("message throttled", "server", server, "attendant", attendant,
+		"command", message.Command(), "instant", instant, "lapse", lapse)
 	if funnel.onMessageThrottled != nil {
 		funnel.onMessageThrottled(server, attendant, message, instant, lapse)
 	}
 }
 
-// Delegates the processing to the handlers.
+// Delegates the processing to the handlers of the published
+// composition. Handlers do not hold the funnel while running,
+// so they may change it, and slow ones do not delay the changes.
 func (funnel *ProtocolsFunnel) MessageArrived(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
-	funnel.handlers.Handle(server, attendant, message, funnel.onMessageUnknown, funnel.onMessagePanic)
+	if funnel.rpc != nil {
+		message = wrapRPC(*funnel.rpc, attendant, message)
+	}
+	funnel.publishedComposition().handlers.Handle(server, attendant, message, funnel.messageUnknown, funnel.messagePanic)
 }
 
 // Executes tha stopped callback safely.
@@ -131,12 +360,18 @@ func (funnel *ProtocolsFunnel) safeAttendantStoppedCallback(server *chasqui.Serv
 	protocol Protocol) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
+			funnel.logger.Error("protocol panicked while stopping for attendant", "server", server,
+				"attendant", attendant, "protocol", ProtocolName(protocol), "panic", recovered,
+				"stack", string(debug.Stack()))
 			if funnel.onAttendantStoppedPanic != nil {
 				funnel.onAttendantStoppedPanic(server, attendant, stopType, err, protocol, recovered)
 			}
 		}
 	}()
-	protocol.AttendantStopped(server, attendant, stopType, err)
+	defer funnel.composition.clearAttendantState(attendant, protocol)
+	attendantStoppedOf(protocol, server, attendant, stopType, err)
+	funnel.logger.Debug("protocol stopped for attendant", "server", server, "attendant", attendant,
+		"protocol", ProtocolName(protocol), "stopType", stopType, "error", err)
 }
 
 // Attempts to "stop" each protocol's relationship with an attendant
@@ -144,19 +379,25 @@ func (funnel *ProtocolsFunnel) safeAttendantStoppedCallback(server *chasqui.Serv
 // all the protocols that started with it. Stop callbacks may panic,
 // and that will be reported, but they shouldn't. Each stop callback
 // will be recovered from panics independently.
+// The context of the attendant is cancelled before that.
 func (funnel *ProtocolsFunnel) AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant,
 	stopType chasqui.AttendantStopType, err error) {
-	var count int
-	var ok bool
-	if count, ok = funnel.attendantLoadProgress[attendant]; !ok {
-		count = len(funnel.flattened)
+	funnel.beginEvent()
+	defer funnel.endEvent()
+	funnel.stopAttendant(server, attendant, funnel.popAttendantRecord(attendant), stopType, err)
+}
+
+// Cancels the context of an attendant, and stops its started
+// protocols in reverse order.
+func (funnel *ProtocolsFunnel) stopAttendant(server *chasqui.Server, attendant *chasqui.Attendant,
+	record *attendantRecord, stopType chasqui.AttendantStopType, err error) {
+	if record.cancel != nil {
+		record.cancel()
 	}
-	for count > 0 {
-		index := count - 1
-		funnel.safeAttendantStoppedCallback(server, attendant, stopType, err, funnel.flattened[index])
-		count = index
+	started := record.started
+	for index := len(started) - 1; index >= 0; index-- {
+		funnel.safeAttendantStoppedCallback(server, attendant, stopType, err, started[index])
 	}
-	delete(funnel.attendantLoadProgress, attendant)
 }
 
 // Option to set the "server started panic" callback to handle the panics
@@ -199,6 +440,14 @@ func WithMessagePanic(callback MessagePanicHandler) func(target *ProtocolsFunnel
 	}
 }
 
+// Option to set the "message invalid" callback to handle when a message
+// does not match the schema declared for its command.
+func WithMessageInvalid(callback MessageInvalidHandler) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onMessageInvalid = callback
+	}
+}
+
 // Option to set the "message throttled" callback to handle when the protocols
 // cannot understand a message.
 func WithMessageThrottled(callback func(*chasqui.Server, *chasqui.Attendant, types.Message, time.Time, time.Duration)) func(target *ProtocolsFunnel) {
@@ -223,34 +472,113 @@ func WithStoppedPanic(callback func(*chasqui.Server, Protocol, interface{})) fun
 	}
 }
 
-// Creates a new protocols funnel. It takes some of the protocols
-// involved, and also takes the options to configure the callbacks
-// for reporting.
-func NewProtocolsFunnel(protocols []Protocol, options ...func(target *ProtocolsFunnel)) (*ProtocolsFunnel, error) {
-	funnel := &ProtocolsFunnel{}
-	if len(protocols) == 0 {
+// Option to enable the request/response correlation mode. Messages
+// carrying the correlation id will be given to the handlers as
+// *RPCMessage values, which can reply to the client.
+func WithRPC(settings RPCSettings) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		settings = settings.withDefaults()
+		target.rpc = &settings
+	}
+}
+
+// Option to add global middlewares, which will wrap every handler
+// of every protocol in the funnel. They will run before the
+// per-protocol and per-command middlewares. This option can be
+// specified many times: the middlewares will be appended.
+func WithMiddlewares(middlewares ...MessageMiddleware) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.middlewares = append(target.middlewares, middlewares...)
+	}
+}
+
+// Builds a composition out of the root protocols: flattens
+// their dependencies (considering the replaced protocols),
+// collects their state keys and merges their handlers.
+func (funnel *ProtocolsFunnel) compose(roots []Protocol, substitutes map[Protocol]Protocol) (*composition, error) {
+	if len(roots) == 0 {
 		return nil, ErrNoProtocols
 	}
-	flattened, err := flatten(protocols)
+	flattened, services, err := flatten(roots, substitutes)
 	if err != nil {
 		return nil, err
-	} else {
-		funnel.flattened = flattened
+	}
+	included := make(Protocols, len(flattened))
+	for _, protocol := range flattened {
+		included[identityOf(protocol)] = true
 	}
 
-	handlers := make(MessageHandlers)
+	stateKeys := make(map[Protocol][]*StateKey)
 	for _, protocol := range flattened {
-		if err := handlers.Merge(protocol.Handlers()); err != nil {
+		if keys, err := stateKeysOf(protocol); err != nil {
 			return nil, err
+		} else if len(keys) != 0 {
+			stateKeys[protocol] = keys
 		}
 	}
-	funnel.handlers = handlers
 
-	funnel.serverLoadProgress = make(map[*chasqui.Server]int)
-	funnel.attendantLoadProgress = make(map[*chasqui.Attendant]int)
+	serverStateKeys := make(map[Protocol][]*ServerStateKey)
+	for _, protocol := range flattened {
+		if keys, err := serverStateKeysOf(protocol); err != nil {
+			return nil, err
+		} else if len(keys) != 0 {
+			serverStateKeys[protocol] = keys
+		}
+	}
 
+	handlers := make(MessageHandlers)
+	handlerOwners := make(map[string]Protocol)
+	for _, protocol := range flattened {
+		ownHandlers := funnel.protocolHandlers(protocol)
+		for command, handler := range ownHandlers {
+			if owner, ok := handlerOwners[command]; ok && handler != nil {
+				return nil, &HandlerConflictError{command, owner, protocol}
+			}
+		}
+		// noinspection GoUnhandledErrorResult
+		handlers.Merge(ownHandlers)
+		for command, handler := range ownHandlers {
+			if handler != nil {
+				handlerOwners[command] = protocol
+			}
+		}
+	}
+	if len(funnel.middlewares) != 0 {
+		handlers = handlers.Wrap(funnel.middlewares...)
+	}
+
+	composition := &composition{
+		roots:           roots,
+		substitutes:     substitutes,
+		flattened:       flattened,
+		included:        included,
+		services:        services,
+		handlers:        handlers,
+		handlerOwners:   handlerOwners,
+		stateKeys:       stateKeys,
+		serverStateKeys: serverStateKeys,
+	}
+	composition.levels = composition.dependencyLevels()
+	return composition, nil
+}
+
+// Creates a new protocols funnel. It takes some of the protocols
+// involved, and also takes the options to configure the callbacks
+// for reporting.
+func NewProtocolsFunnel(protocols []Protocol, options ...func(target *ProtocolsFunnel)) (*ProtocolsFunnel, error) {
+	funnel := &ProtocolsFunnel{logger: NopLogger, baseContext: context.Background()}
 	for _, option := range options {
 		option(funnel)
 	}
+
+	composition, err := funnel.compose(append([]Protocol(nil), protocols...), nil)
+	if err != nil {
+		return nil, err
+	}
+	funnel.setComposition(composition)
+	funnel.target = composition
+	funnel.gateCond = sync.NewCond(&funnel.gateMutex)
+	funnel.servers = make(map[*chasqui.Server]*serverRecord)
+	funnel.attendants = make(map[*chasqui.Attendant]*attendantRecord)
 	return funnel, nil
 }
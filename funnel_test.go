@@ -0,0 +1,304 @@
+package protocols
+
+import (
+	"errors"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testServers              = 4
+	testAttendantsPerServer  = 200
+	testMessagesPerAttendant = 5
+)
+
+// A message with no arguments.
+type testMessage string
+
+func (message testMessage) Command() string {
+	return string(message)
+}
+
+func (message testMessage) Args() types.Args {
+	return nil
+}
+
+func (message testMessage) KWArgs() types.KWArgs {
+	return nil
+}
+
+// Tells whether a protocol started for an attendant.
+type testMark struct {
+	started bool
+}
+
+// A protocol counting its lifecycle events, and checking its
+// state (and the state of its dependency, if any) on each one.
+type testProtocol struct {
+	t                 *testing.T
+	name              string
+	dependency        *testProtocol
+	stateKey          *StateKey
+	serverStateKey    *ServerStateKey
+	serversStarted    int64
+	serversStopped    int64
+	attendantsStarted int64
+	attendantsStopped int64
+	serverStops       int64
+	messagesHandled   int64
+}
+
+func newTestProtocol(t *testing.T, name string, dependency *testProtocol) *testProtocol {
+	protocol := &testProtocol{t: t, name: name, dependency: dependency}
+	protocol.stateKey = NewStateKey(protocol, name, (*testMark)(nil))
+	protocol.serverStateKey = NewServerStateKey(protocol, name, (*testMark)(nil))
+	return protocol
+}
+
+func (protocol *testProtocol) Name() string {
+	return protocol.name
+}
+
+func (protocol *testProtocol) Dependencies() Protocols {
+	if protocol.dependency == nil {
+		return nil
+	}
+	return Protocols{protocol.dependency: true}
+}
+
+func (protocol *testProtocol) StateKeys() []*StateKey {
+	return []*StateKey{protocol.stateKey}
+}
+
+func (protocol *testProtocol) ServerStateKeys() []*ServerStateKey {
+	return []*ServerStateKey{protocol.serverStateKey}
+}
+
+func (protocol *testProtocol) Handlers() MessageHandlers {
+	return MessageHandlers{
+		protocol.name: func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+			protocol.checkAttendant(attendant, "handling a message", true)
+			atomic.AddInt64(&protocol.messagesHandled, 1)
+		},
+	}
+}
+
+// Checks the attendant state of the protocol and of its dependency.
+func (protocol *testProtocol) checkAttendant(attendant *chasqui.Attendant, event string, started bool) {
+	if value, ok := protocol.stateKey.Get(attendant); !ok {
+		protocol.t.Errorf("%s: no attendant state while %s", protocol.name, event)
+	} else if value.(*testMark).started != started {
+		protocol.t.Errorf("%s: attendant started = %v while %s", protocol.name, !started, event)
+	}
+	if protocol.dependency != nil {
+		if value, ok := protocol.dependency.stateKey.Get(attendant); !ok || !value.(*testMark).started {
+			protocol.t.Errorf("%s: dependency not started for the attendant while %s", protocol.name, event)
+		}
+	}
+}
+
+// Checks the server state of the protocol and of its dependency.
+func (protocol *testProtocol) checkServer(server *chasqui.Server, event string, started bool) {
+	if value, ok := protocol.serverStateKey.Get(server); !ok {
+		protocol.t.Errorf("%s: no server state while %s", protocol.name, event)
+	} else if value.(*testMark).started != started {
+		protocol.t.Errorf("%s: server started = %v while %s", protocol.name, !started, event)
+	}
+	if protocol.dependency != nil {
+		if value, ok := protocol.dependency.serverStateKey.Get(server); !ok || !value.(*testMark).started {
+			protocol.t.Errorf("%s: dependency not started for the server while %s", protocol.name, event)
+		}
+	}
+}
+
+func (protocol *testProtocol) Started(server *chasqui.Server, addr *net.TCPAddr) {
+	protocol.checkServer(server, "starting", false)
+	value, _ := protocol.serverStateKey.Get(server)
+	value.(*testMark).started = true
+	atomic.AddInt64(&protocol.serversStarted, 1)
+}
+
+func (protocol *testProtocol) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+	protocol.checkAttendant(attendant, "starting", false)
+	value, _ := protocol.stateKey.Get(attendant)
+	value.(*testMark).started = true
+	atomic.AddInt64(&protocol.attendantsStarted, 1)
+}
+
+func (protocol *testProtocol) AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant,
+	stopType chasqui.AttendantStopType, err error) {
+	protocol.checkAttendant(attendant, "stopping", true)
+	atomic.AddInt64(&protocol.attendantsStopped, 1)
+	if errors.Is(err, ErrServerStopped) {
+		atomic.AddInt64(&protocol.serverStops, 1)
+	}
+}
+
+func (protocol *testProtocol) Stopped(server *chasqui.Server) {
+	protocol.checkServer(server, "stopping", true)
+	atomic.AddInt64(&protocol.serversStopped, 1)
+}
+
+// Runs the whole lifecycle of several servers, and hundreds of
+// attendants, concurrently on the same funnel. If told so, half
+// of the attendants are still running when their server stops.
+func runConcurrentLifecycle(t *testing.T, leaveLive bool, options ...func(target *ProtocolsFunnel)) {
+	base := newTestProtocol(t, "base", nil)
+	sibling := newTestProtocol(t, "sibling", nil)
+	dependent := newTestProtocol(t, "dependent", base)
+	funnel, err := NewProtocolsFunnel([]Protocol{dependent, sibling}, options...)
+	if err != nil {
+		t.Fatalf("unexpected error creating the funnel: %v", err)
+	}
+
+	var servers sync.WaitGroup
+	for serverIndex := 0; serverIndex < testServers; serverIndex++ {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			server := &chasqui.Server{}
+			funnel.Started(server, nil)
+			var attendants sync.WaitGroup
+			for attendantIndex := 0; attendantIndex < testAttendantsPerServer; attendantIndex++ {
+				attendants.Add(1)
+				live := leaveLive && attendantIndex%2 == 0
+				go func() {
+					defer attendants.Done()
+					attendant := &chasqui.Attendant{}
+					funnel.AttendantStarted(server, attendant)
+					for messageIndex := 0; messageIndex < testMessagesPerAttendant; messageIndex++ {
+						funnel.MessageArrived(server, attendant, testMessage("dependent"))
+						funnel.MessageArrived(server, attendant, testMessage("sibling"))
+					}
+					if !live {
+						funnel.AttendantStopped(server, attendant, chasqui.AttendantStopType(0), nil)
+					}
+				}()
+			}
+			attendants.Wait()
+			funnel.Stopped(server)
+		}()
+	}
+	servers.Wait()
+
+	attendants := int64(testServers * testAttendantsPerServer)
+	var liveAttendants int64
+	if leaveLive {
+		liveAttendants = attendants / 2
+	}
+	for _, protocol := range []*testProtocol{base, sibling, dependent} {
+		if protocol.serversStarted != testServers || protocol.serversStopped != testServers {
+			t.Errorf("%s: %d servers started and %d stopped, expected %d", protocol.name,
+				protocol.serversStarted, protocol.serversStopped, testServers)
+		}
+		if protocol.attendantsStarted != attendants || protocol.attendantsStopped != attendants {
+			t.Errorf("%s: %d attendants started and %d stopped, expected %d", protocol.name,
+				protocol.attendantsStarted, protocol.attendantsStopped, attendants)
+		}
+		if protocol.serverStops != liveAttendants {
+			t.Errorf("%s: %d attendants stopped by their server, expected %d", protocol.name,
+				protocol.serverStops, liveAttendants)
+		}
+		if len(protocol.stateKey.values) != 0 || len(protocol.serverStateKey.values) != 0 {
+			t.Errorf("%s: state left after stopping", protocol.name)
+		}
+	}
+	messages := attendants * testMessagesPerAttendant
+	if dependent.messagesHandled != messages || sibling.messagesHandled != messages {
+		t.Errorf("%d and %d messages handled, expected %d", dependent.messagesHandled,
+			sibling.messagesHandled, messages)
+	}
+	if len(funnel.servers) != 0 || len(funnel.attendants) != 0 {
+		t.Errorf("%d server records and %d attendant records left after stopping", len(funnel.servers),
+			len(funnel.attendants))
+	}
+}
+
+func TestConcurrentLifecycle(t *testing.T) {
+	runConcurrentLifecycle(t, false)
+}
+
+func TestConcurrentLifecycleWithParallelStartup(t *testing.T) {
+	runConcurrentLifecycle(t, false, WithParallelStartup())
+}
+
+func TestServerStoppedWithLiveAttendants(t *testing.T) {
+	runConcurrentLifecycle(t, true)
+}
+
+// A protocol adding another protocol to its funnel, from a handler
+// or (if told so) from its AttendantStarted callback.
+type addingProtocol struct {
+	BaseProtocol
+	funnel  *ProtocolsFunnel
+	added   Protocol
+	onStart bool
+	errors  chan error
+}
+
+func (protocol *addingProtocol) add() {
+	protocol.errors <- protocol.funnel.AddProtocol(protocol.added)
+}
+
+func (protocol *addingProtocol) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+	if protocol.onStart {
+		protocol.add()
+	}
+}
+
+func (protocol *addingProtocol) Handlers() MessageHandlers {
+	return MessageHandlers{
+		"ADD": func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+			protocol.add()
+		},
+	}
+}
+
+// Runs a function, failing if it does not end in a second.
+func runWithDeadline(t *testing.T, name string, function func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		function()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not end: the funnel deadlocked", name)
+	}
+}
+
+func TestChangesFromCallbacks(t *testing.T) {
+	for _, fromHandler := range []bool{true, false} {
+		added := newTestProtocol(t, "added", nil)
+		adding := &addingProtocol{added: added, onStart: !fromHandler, errors: make(chan error, 1)}
+		funnel, err := NewProtocolsFunnel([]Protocol{adding})
+		if err != nil {
+			t.Fatalf("unexpected error creating the funnel: %v", err)
+		}
+		adding.funnel = funnel
+		server := &chasqui.Server{}
+		attendant := &chasqui.Attendant{}
+		runWithDeadline(t, "starting", func() {
+			funnel.Started(server, nil)
+			funnel.AttendantStarted(server, attendant)
+			if fromHandler {
+				funnel.MessageArrived(server, attendant, testMessage("ADD"))
+			}
+		})
+		if err := <-adding.errors; err != nil {
+			t.Fatalf("unexpected error adding a protocol: %v", err)
+		}
+		if !funnel.Includes(added) || added.serversStarted != 1 || added.attendantsStarted != 1 {
+			t.Errorf("the protocol was not added and started (from handler: %v)", fromHandler)
+		}
+		runWithDeadline(t, "stopping", func() {
+			funnel.Stopped(server)
+		})
+	}
+}
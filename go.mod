@@ -1,5 +1,10 @@
 module github.com/universe-10th/chasqui-protocols
 
-go 1.14
+go 1.18
 
-require github.com/universe-10th/chasqui v0.0.5
+require (
+	github.com/universe-10th/chasqui v0.0.5
+	golang.org/x/crypto v0.9.0
+)
+
+require golang.org/x/sys v0.8.0 // indirect
@@ -0,0 +1,206 @@
+package protocols
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kind of a dependency edge.
+type DependencyKind string
+
+const (
+	HardDependency     DependencyKind = "hard"
+	OptionalDependency DependencyKind = "optional"
+	ServiceDependency  DependencyKind = "service"
+)
+
+// Tells that a funneled protocol depends on another one.
+type DependencyEdge struct {
+	From Protocol
+	To   Protocol
+	Kind DependencyKind
+}
+
+// A snapshot of the composition of a funnel: the protocols in
+// startup order (teardown order is the reverse), the edges
+// among them, and which protocol handles each command.
+type Graph struct {
+	Order    []Protocol
+	Edges    []DependencyEdge
+	Commands map[string]Protocol
+}
+
+// Gets the funneled instance of a protocol, if it is funneled.
+func (composition *composition) instanceOf(protocol Protocol) (Protocol, bool) {
+	identity := identityOf(substituteOf(protocol, composition.substitutes))
+	for _, candidate := range composition.flattened {
+		if identityOf(candidate) == identity {
+			return candidate, true
+		}
+	}
+	return nil, false
+}
+
+// Builds the graph of a composition. Edges are sorted by the
+// startup order of their ends, and then by their kind.
+func (composition *composition) graph() *Graph {
+	positions := make(map[Protocol]int, len(composition.flattened))
+	for index, protocol := range composition.flattened {
+		positions[protocol] = index
+	}
+
+	var edges []DependencyEdge
+	addEdges := func(from Protocol, dependencies []Protocol, kind DependencyKind) {
+		for _, dependency := range dependencies {
+			if to, ok := composition.instanceOf(dependency); ok {
+				edges = append(edges, DependencyEdge{from, to, kind})
+			}
+		}
+	}
+	for _, protocol := range composition.flattened {
+		addEdges(protocol, dependenciesOf(protocol), HardDependency)
+		addEdges(protocol, sortProtocols(optionalDependenciesOf(protocol)), OptionalDependency)
+		addEdges(protocol, sortProtocols(composition.services.dependencies[identityOf(protocol)]), ServiceDependency)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if positions[edges[i].From] != positions[edges[j].From] {
+			return positions[edges[i].From] < positions[edges[j].From]
+		}
+		if positions[edges[i].To] != positions[edges[j].To] {
+			return positions[edges[i].To] < positions[edges[j].To]
+		}
+		return edges[i].Kind < edges[j].Kind
+	})
+
+	commands := make(map[string]Protocol, len(composition.handlerOwners))
+	for command, owner := range composition.handlerOwners {
+		commands[command] = owner
+	}
+	return &Graph{
+		Order:    append([]Protocol(nil), composition.flattened...),
+		Edges:    edges,
+		Commands: commands,
+	}
+}
+
+// Gets a snapshot of the current composition. It is safe to
+// invoke this method from anywhere, including handlers and
+// lifecycle callbacks.
+func (funnel *ProtocolsFunnel) Graph() *Graph {
+	return funnel.publishedComposition().graph()
+}
+
+// Gets the funneled protocols, in startup order.
+func (funnel *ProtocolsFunnel) Order() []Protocol {
+	return append([]Protocol(nil), funnel.publishedComposition().flattened...)
+}
+
+// Gets which protocol handles each command.
+func (funnel *ProtocolsFunnel) Commands() map[string]Protocol {
+	return funnel.Graph().Commands
+}
+
+// Gets the commands, sorted by name.
+func (graph *Graph) sortedCommands() []string {
+	commands := make([]string, 0, len(graph.Commands))
+	for command := range graph.Commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// Gets a name for each protocol which does not change among runs:
+// its stable name (see stableNameOf), followed by its occurrence
+// number (e.g. "*pkg.Protocol#2") when several protocols share it.
+func (graph *Graph) stableNames() map[Protocol]string {
+	counts := make(map[string]int, len(graph.Order))
+	for _, protocol := range graph.Order {
+		counts[stableNameOf(protocol)]++
+	}
+	occurrences := make(map[string]int, len(counts))
+	names := make(map[Protocol]string, len(graph.Order))
+	for _, protocol := range graph.Order {
+		name := stableNameOf(protocol)
+		if counts[name] > 1 {
+			occurrences[name]++
+			names[protocol] = name + "#" + strconv.Itoa(occurrences[name])
+		} else {
+			names[protocol] = name
+		}
+	}
+	return names
+}
+
+// Renders the graph in Graphviz DOT format. Nodes are labelled
+// with the stable protocol names and their handled commands, and
+// the optional and service edges are dashed and dotted,
+// respectively.
+func (graph *Graph) DOT() string {
+	names := graph.stableNames()
+	ids := make(map[Protocol]string, len(graph.Order))
+	commands := make(map[Protocol][]string)
+	for _, command := range graph.sortedCommands() {
+		owner := graph.Commands[command]
+		commands[owner] = append(commands[owner], command)
+	}
+
+	var builder strings.Builder
+	builder.WriteString("digraph protocols {\n")
+	for index, protocol := range graph.Order {
+		ids[protocol] = "p" + strconv.Itoa(index)
+		label := names[protocol]
+		if len(commands[protocol]) != 0 {
+			label += "\n" + strings.Join(commands[protocol], ", ")
+		}
+		builder.WriteString("  " + ids[protocol] + " [label=" + strconv.Quote(label) + "];\n")
+	}
+	for _, edge := range graph.Edges {
+		builder.WriteString("  " + ids[edge.From] + " -> " + ids[edge.To])
+		switch edge.Kind {
+		case OptionalDependency:
+			builder.WriteString(" [style=dashed]")
+		case ServiceDependency:
+			builder.WriteString(" [style=dotted]")
+		}
+		builder.WriteString(";\n")
+	}
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+type jsonEdge struct {
+	From string         `json:"from"`
+	To   string         `json:"to"`
+	Kind DependencyKind `json:"kind"`
+}
+
+type jsonGraph struct {
+	Order    []string          `json:"order"`
+	Edges    []jsonEdge        `json:"edges"`
+	Commands map[string]string `json:"commands"`
+}
+
+// Renders the graph in JSON format, with the protocols being
+// referenced by their stable names. The output does not change
+// among runs, so it can be diffed.
+func (graph *Graph) MarshalJSON() ([]byte, error) {
+	names := graph.stableNames()
+	result := jsonGraph{
+		Order:    make([]string, len(graph.Order)),
+		Edges:    make([]jsonEdge, len(graph.Edges)),
+		Commands: make(map[string]string, len(graph.Commands)),
+	}
+	for index, protocol := range graph.Order {
+		result.Order[index] = names[protocol]
+	}
+	for index, edge := range graph.Edges {
+		result.Edges[index] = jsonEdge{names[edge.From], names[edge.To], edge.Kind}
+	}
+	for command, owner := range graph.Commands {
+		result.Commands[command] = names[owner]
+	}
+	return json.Marshal(result)
+}
@@ -9,6 +9,24 @@ import (
 
 var ErrHandlerConflict = errors.New("a handler is already registered with that key")
 
+// Describes a command being handled by two different
+// protocols in the same funnel. It satisfies errors.Is
+// against the ErrHandlerConflict sentinel.
+type HandlerConflictError struct {
+	Command  string
+	Existing Protocol
+	Incoming Protocol
+}
+
+func (conflictError *HandlerConflictError) Error() string {
+	return fmt.Sprintf("%s: command %q is handled by both %s and %s", ErrHandlerConflict.Error(),
+		conflictError.Command, ProtocolName(conflictError.Existing), ProtocolName(conflictError.Incoming))
+}
+
+func (conflictError *HandlerConflictError) Is(target error) bool {
+	return target == ErrHandlerConflict
+}
+
 // Handling a message involves the server, the
 // involved attendant, and the received message.
 type MessageHandler func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message)
@@ -38,7 +56,6 @@ func (handlers MessageHandlers) Handle(server *chasqui.Server, attendant *chasqu
 			if onPanic != nil {
 				onPanic(server, attendant, message, recovered)
 			}
-			fmt.Println("Panic on handle!", recovered)
 		}
 	}()
 	if onMessage, exists := handlers[message.Command()]; exists {
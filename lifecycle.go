@@ -0,0 +1,79 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"net"
+)
+
+// Dependent is an optional extension of Protocol to declare the
+// protocols it depends on. See Protocol for the contract.
+type Dependent interface {
+	Dependencies() Protocols
+}
+
+// ServerStarter is an optional extension of Protocol to initialize
+// it for a server. See Protocol for the contract.
+type ServerStarter interface {
+	Started(server *chasqui.Server, addr *net.TCPAddr)
+}
+
+// AttendantStarter is an optional extension of Protocol to initialize
+// it for an attendant. See Protocol for the contract.
+type AttendantStarter interface {
+	AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant)
+}
+
+// AttendantStopper is an optional extension of Protocol to finalize
+// it for an attendant. See Protocol for the contract.
+type AttendantStopper interface {
+	AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant, stopType chasqui.AttendantStopType, err error)
+}
+
+// ServerStopper is an optional extension of Protocol to finalize it
+// for a server. See Protocol for the contract.
+type ServerStopper interface {
+	Stopped(server *chasqui.Server)
+}
+
+// BaseProtocol can be embedded in protocols to have no dependencies
+// and no-op lifecycle methods by default. Embedding protocols only
+// need to implement Handlers() and override the methods they need.
+type BaseProtocol struct{}
+
+func (BaseProtocol) Dependencies() Protocols {
+	return nil
+}
+
+func (BaseProtocol) Started(server *chasqui.Server, addr *net.TCPAddr) {}
+
+func (BaseProtocol) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {}
+
+func (BaseProtocol) AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant,
+	stopType chasqui.AttendantStopType, err error) {
+}
+
+func (BaseProtocol) Stopped(server *chasqui.Server) {}
+
+// Gets the hard dependencies of a protocol, if any.
+func hardDependenciesOf(protocol Protocol) Protocols {
+	if dependent, ok := protocol.(Dependent); ok {
+		return dependent.Dependencies()
+	}
+	return nil
+}
+
+// Finalizes a protocol for a server, if it implements ServerStopper.
+func stoppedOf(protocol Protocol, server *chasqui.Server) {
+	if stopper, ok := protocol.(ServerStopper); ok {
+		stopper.Stopped(server)
+	}
+}
+
+// Finalizes a protocol for an attendant, if it implements
+// AttendantStopper.
+func attendantStoppedOf(protocol Protocol, server *chasqui.Server, attendant *chasqui.Attendant,
+	stopType chasqui.AttendantStopType, err error) {
+	if stopper, ok := protocol.(AttendantStopper); ok {
+		stopper.AttendantStopped(server, attendant, stopType, err)
+	}
+}
@@ -0,0 +1,70 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"runtime/debug"
+)
+
+// Loggers receive a message and alternating key/value
+// pairs, in the same way of log/slog. Hence, a *slog.Logger
+// can be used directly as a logger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// The default logger, which discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// A logger discarding everything.
+var NopLogger Logger = nopLogger{}
+
+// Option to set the logger for the funnel. Every lifecycle event,
+// panic (with its stack trace), unknown message and throttled
+// message will be logged there. By default, nothing is logged.
+func WithLogger(logger Logger) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		if logger == nil {
+			logger = NopLogger
+		}
+		target.logger = logger
+	}
+}
+
+// Logs and reports an unknown message.
+func (funnel *ProtocolsFunnel) messageUnknown(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+	funnel.logger.Warn("unknown message", "server", server, "attendant", attendant, "command", message.Command())
+	if funnel.onMessageUnknown != nil {
+		funnel.onMessageUnknown(server, attendant, message)
+	}
+}
+
+// Logs and reports a message not matching its command schema.
+func (funnel *ProtocolsFunnel) messageInvalid(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	err *ValidationError) {
+	funnel.logger.Warn("invalid message", "server", server, "attendant", attendant, "command", message.Command(),
+		"error", err)
+	if funnel.onMessageInvalid != nil {
+		funnel.onMessageInvalid(server, attendant, message, err)
+	}
+}
+
+// Logs and reports a panic while handling a message. It must be
+// invoked while recovering, so the stack trace is the panicking
+// one.
+func (funnel *ProtocolsFunnel) messagePanic(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	recovered interface{}) {
+	funnel.logger.Error("message handler panicked", "server", server, "attendant", attendant,
+		"command", message.Command(), "panic", recovered, "stack", string(debug.Stack()))
+	if funnel.onMessagePanic != nil {
+		funnel.onMessagePanic(server, attendant, message, recovered)
+	}
+}
@@ -0,0 +1,66 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"sync"
+)
+
+// Tracks which funnel serves each running server, so protocols
+// can look up the composition through the server they get in
+// their callbacks and handlers.
+var servingFunnels = struct {
+	sync.RWMutex
+	funnels map[*chasqui.Server]*ProtocolsFunnel
+}{funnels: make(map[*chasqui.Server]*ProtocolsFunnel)}
+
+// Tells that a funnel is serving a server.
+func registerServingFunnel(server *chasqui.Server, funnel *ProtocolsFunnel) {
+	servingFunnels.Lock()
+	defer servingFunnels.Unlock()
+	servingFunnels.funnels[server] = funnel
+}
+
+// Tells that a funnel is not serving a server anymore.
+func unregisterServingFunnel(server *chasqui.Server) {
+	servingFunnels.Lock()
+	defer servingFunnels.Unlock()
+	delete(servingFunnels.funnels, server)
+}
+
+// Gets the funnel serving a server, if any.
+func ServingFunnel(server *chasqui.Server) (*ProtocolsFunnel, bool) {
+	servingFunnels.RLock()
+	defer servingFunnels.RUnlock()
+	funnel, ok := servingFunnels.funnels[server]
+	return funnel, ok
+}
+
+// Sets the current composition, and publishes it so it can be
+// read without holding the funnel.
+func (funnel *ProtocolsFunnel) setComposition(composition *composition) {
+	funnel.composition = composition
+	funnel.published.Store(composition)
+}
+
+// Gets the current composition without holding the funnel.
+func (funnel *ProtocolsFunnel) publishedComposition() *composition {
+	return funnel.published.Load().(*composition)
+}
+
+// Tells whether a protocol (or a decorated version of it) is
+// currently funneled. It is safe to invoke this method from
+// anywhere, including handlers and lifecycle callbacks.
+func (funnel *ProtocolsFunnel) Includes(protocol Protocol) bool {
+	return funnel.publishedComposition().included[identityOf(protocol)]
+}
+
+// Tells whether a protocol (or a decorated version of it) is
+// funneled for a running server. Protocols use this function
+// to check whether their optional dependencies are present,
+// e.g. in their Started callback.
+func Included(server *chasqui.Server, protocol Protocol) bool {
+	if funnel, ok := ServingFunnel(server); ok {
+		return funnel.Includes(protocol)
+	}
+	return false
+}
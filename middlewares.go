@@ -0,0 +1,68 @@
+package protocols
+
+// Middlewares wrap a message handler into another one,
+// typically to perform cross-cutting logic (e.g. logging,
+// authentication, validation, metrics) before and/or
+// after the wrapped handler runs. A middleware may
+// short-circuit the handling by just not invoking the
+// wrapped handler.
+type MessageMiddleware func(MessageHandler) MessageHandler
+
+// Protocols may optionally implement this interface to
+// have their middlewares applied to all of their own
+// handlers (and only to them). These middlewares will
+// run after the global ones (the ones specified in the
+// funnel) and before the per-command ones.
+type MiddlewareProvider interface {
+	Middlewares() []MessageMiddleware
+}
+
+// Wraps a handler with the given middlewares. The first
+// middleware will be the outermost one (i.e. the first
+// one to run), and the handler will be the innermost.
+// This function is the intended way to specify per-command
+// middlewares, while building the handlers of a protocol.
+func Chain(handler MessageHandler, middlewares ...MessageMiddleware) MessageHandler {
+	if handler == nil {
+		return nil
+	}
+	for index := len(middlewares) - 1; index >= 0; index-- {
+		if middleware := middlewares[index]; middleware != nil {
+			handler = middleware(handler)
+		}
+	}
+	return handler
+}
+
+// Returns a new handlers map with each of its handlers
+// wrapped by the given middlewares, in the same order
+// they are wrapped by Chain.
+func (handlers MessageHandlers) Wrap(middlewares ...MessageMiddleware) MessageHandlers {
+	wrapped := make(MessageHandlers, len(handlers))
+	for key, handler := range handlers {
+		wrapped[key] = Chain(handler, middlewares...)
+	}
+	return wrapped
+}
+
+// Gets the handlers of a protocol, validated by their schemas,
+// wrapped by the protocol's own middlewares, if it provides
+// them, and running with their deadlines, if any.
+func (funnel *ProtocolsFunnel) protocolHandlers(protocol Protocol) MessageHandlers {
+	handlers := protocol.Handlers()
+	if provider, ok := protocol.(SchemaProvider); ok {
+		if schemas := provider.Schemas(); len(schemas) != 0 {
+			validatedHandlers := make(MessageHandlers, len(handlers))
+			for key, handler := range handlers {
+				validatedHandlers[key] = validated(handler, schemas[key], funnel.messageInvalid)
+			}
+			handlers = validatedHandlers
+		}
+	}
+	if provider, ok := protocol.(MiddlewareProvider); ok {
+		if middlewares := provider.Middlewares(); len(middlewares) != 0 {
+			handlers = handlers.Wrap(middlewares...)
+		}
+	}
+	return funnel.timedHandlers(protocol, handlers)
+}
@@ -0,0 +1,190 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"net"
+	"reflect"
+	"time"
+)
+
+// The default separator between the prefix and the command
+// name in namespaced protocols.
+const DefaultNamespaceSeparator = "."
+
+// Namespaced protocols decorate another protocol by adding
+// a prefix to all of its command names. Aside from that,
+// they behave exactly like the decorated protocol, and they
+// are considered the same protocol when resolving the
+// dependencies: other protocols may still depend on the
+// decorated protocol and the namespaced one will be used.
+type NamespacedProtocol struct {
+	protocol  Protocol
+	prefix    string
+	separator string
+}
+
+// The prefix being added to the command names.
+func (namespaced *NamespacedProtocol) Prefix() string {
+	return namespaced.prefix
+}
+
+// The separator between the prefix and the command names.
+func (namespaced *NamespacedProtocol) Separator() string {
+	return namespaced.separator
+}
+
+// The decorated protocol.
+func (namespaced *NamespacedProtocol) Unwrap() Protocol {
+	return namespaced.protocol
+}
+
+// The dependencies are the same of the decorated protocol.
+func (namespaced *NamespacedProtocol) Dependencies() Protocols {
+	return hardDependenciesOf(namespaced.protocol)
+}
+
+// The ordered dependencies of the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) OrderedDependencies() []Protocol {
+	if dependent, ok := namespaced.protocol.(OrderedDependent); ok {
+		return dependent.OrderedDependencies()
+	}
+	return nil
+}
+
+// The optional dependencies of the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) OptionalDependencies() Protocols {
+	return optionalDependenciesOf(namespaced.protocol)
+}
+
+// The services provided by the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) Provides() []reflect.Type {
+	return providedServicesOf(namespaced.protocol)
+}
+
+// The services required by the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) Requires() []reflect.Type {
+	return requiredServicesOf(namespaced.protocol)
+}
+
+// The handlers of the decorated protocol, with their keys
+// being prefixed.
+func (namespaced *NamespacedProtocol) Handlers() MessageHandlers {
+	handlers := namespaced.protocol.Handlers()
+	if handlers == nil {
+		return nil
+	}
+	prefixed := make(MessageHandlers, len(handlers))
+	for key, handler := range handlers {
+		prefixed[namespaced.prefix+namespaced.separator+key] = handler
+	}
+	return prefixed
+}
+
+// The schemas of the decorated protocol, if any, with their
+// keys being prefixed.
+func (namespaced *NamespacedProtocol) Schemas() map[string]*MessageSchema {
+	provider, ok := namespaced.protocol.(SchemaProvider)
+	if !ok {
+		return nil
+	}
+	schemas := provider.Schemas()
+	if schemas == nil {
+		return nil
+	}
+	prefixed := make(map[string]*MessageSchema, len(schemas))
+	for key, schema := range schemas {
+		prefixed[namespaced.prefix+namespaced.separator+key] = schema
+	}
+	return prefixed
+}
+
+// The timeouts are the same of the decorated protocol, but with
+// the prefixed command names.
+func (namespaced *NamespacedProtocol) Timeouts() map[string]time.Duration {
+	provider, ok := namespaced.protocol.(TimeoutProvider)
+	if !ok {
+		return nil
+	}
+	timeouts := provider.Timeouts()
+	if timeouts == nil {
+		return nil
+	}
+	prefixed := make(map[string]time.Duration, len(timeouts))
+	for key, timeout := range timeouts {
+		prefixed[namespaced.prefix+namespaced.separator+key] = timeout
+	}
+	return prefixed
+}
+
+// The middlewares of the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) Middlewares() []MessageMiddleware {
+	if provider, ok := namespaced.protocol.(MiddlewareProvider); ok {
+		return provider.Middlewares()
+	}
+	return nil
+}
+
+// The state keys of the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) StateKeys() []*StateKey {
+	if owner, ok := namespaced.protocol.(StateOwner); ok {
+		return owner.StateKeys()
+	}
+	return nil
+}
+
+// The server state keys of the decorated protocol, if any.
+func (namespaced *NamespacedProtocol) ServerStateKeys() []*ServerStateKey {
+	if owner, ok := namespaced.protocol.(ServerStateOwner); ok {
+		return owner.ServerStateKeys()
+	}
+	return nil
+}
+
+// Starts the decorated protocol for a server. A veto of the
+// decorated protocol is panicked, as in the plain contract.
+func (namespaced *NamespacedProtocol) Started(server *chasqui.Server, addr *net.TCPAddr) {
+	if err := startedOf(namespaced.protocol, server, addr); err != nil {
+		panic(err)
+	}
+}
+
+// Starts the decorated protocol for an attendant. A veto of the
+// decorated protocol is panicked, as in the plain contract.
+func (namespaced *NamespacedProtocol) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+	if err := attendantStartedOf(namespaced.protocol, server, attendant); err != nil {
+		panic(err)
+	}
+}
+
+// Starts the decorated protocol for a server, forwarding its veto
+// if it implements VetoingStarter.
+func (namespaced *NamespacedProtocol) StartedE(server *chasqui.Server, addr *net.TCPAddr) error {
+	return startedOf(namespaced.protocol, server, addr)
+}
+
+// Starts the decorated protocol for an attendant, forwarding its
+// veto if it implements VetoingAttendantStarter.
+func (namespaced *NamespacedProtocol) AttendantStartedE(server *chasqui.Server, attendant *chasqui.Attendant) error {
+	return attendantStartedOf(namespaced.protocol, server, attendant)
+}
+
+func (namespaced *NamespacedProtocol) AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant,
+	stopType chasqui.AttendantStopType, err error) {
+	attendantStoppedOf(namespaced.protocol, server, attendant, stopType, err)
+}
+
+func (namespaced *NamespacedProtocol) Stopped(server *chasqui.Server) {
+	stoppedOf(namespaced.protocol, server)
+}
+
+// Decorates a protocol by prefixing its command names with the
+// given prefix and the default separator.
+func Namespaced(prefix string, protocol Protocol) *NamespacedProtocol {
+	return NamespacedWithSeparator(prefix, DefaultNamespaceSeparator, protocol)
+}
+
+// Decorates a protocol by prefixing its command names with the
+// given prefix and separator.
+func NamespacedWithSeparator(prefix, separator string, protocol Protocol) *NamespacedProtocol {
+	return &NamespacedProtocol{protocol, prefix, separator}
+}
@@ -0,0 +1,115 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrAmbiguousOrder = errors.New("sibling protocols have the same priority and name, so their order is ambiguous")
+
+// Protocols may optionally implement this interface to declare
+// their dependencies in a given order. Siblings are started in
+// that order (provided they do not depend on each other). The
+// dependencies returned by Dependencies() but not listed here
+// are started after the listed ones.
+type OrderedDependent interface {
+	OrderedDependencies() []Protocol
+}
+
+// Protocols may optionally implement this interface to break
+// ties among sibling dependencies declared in a map: lower
+// priorities start first. The default priority is 0.
+type Prioritized interface {
+	Priority() int
+}
+
+// Gets the priority of a protocol. Decorated protocols are
+// traversed until a prioritized one is found.
+func priorityOf(protocol Protocol) int {
+	for current := protocol; current != nil; {
+		if prioritized, ok := current.(Prioritized); ok {
+			return prioritized.Priority()
+		} else if wrapper, ok := current.(ProtocolWrapper); ok {
+			current = wrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+	return 0
+}
+
+// Gets a name of a protocol which does not change among runs:
+// its name, if it is named, or its type otherwise.
+func stableNameOf(protocol Protocol) string {
+	for current := protocol; current != nil; {
+		if named, ok := current.(Named); ok {
+			return named.Name()
+		} else if wrapper, ok := current.(ProtocolWrapper); ok {
+			current = wrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+	return fmt.Sprintf("%T", identityOf(protocol))
+}
+
+// Sorts a set of protocols by priority and then by stable name.
+// Protocols with the same priority and stable name keep no given
+// order among them: see checkOrder.
+func sortProtocols(protocols Protocols) []Protocol {
+	sorted := make([]Protocol, 0, len(protocols))
+	for protocol := range protocols {
+		sorted = append(sorted, protocol)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if priorityI, priorityJ := priorityOf(sorted[i]), priorityOf(sorted[j]); priorityI != priorityJ {
+			return priorityI < priorityJ
+		}
+		return stableNameOf(sorted[i]) < stableNameOf(sorted[j])
+	})
+	return sorted
+}
+
+// Checks that the sorted dependencies of a protocol are in
+// a stable order, i.e. no two different ones have the same
+// priority and stable name. It fails with ErrAmbiguousOrder
+// otherwise.
+func checkOrder(dependent Protocol, sorted []Protocol) error {
+	for index := 1; index < len(sorted); index++ {
+		previous, current := sorted[index-1], sorted[index]
+		if identityOf(previous) != identityOf(current) && priorityOf(previous) == priorityOf(current) &&
+			stableNameOf(previous) == stableNameOf(current) {
+			return fmt.Errorf("%w: two dependencies of %s are %s, with priority %d", ErrAmbiguousOrder,
+				stableNameOf(dependent), stableNameOf(current), priorityOf(current))
+		}
+	}
+	return nil
+}
+
+// Gets the hard dependencies of a protocol in a stable order,
+// split in two: the ordered ones, and the remaining ones, sorted.
+func splitDependenciesOf(protocol Protocol) ([]Protocol, []Protocol) {
+	var ordered []Protocol
+	if dependent, ok := protocol.(OrderedDependent); ok {
+		ordered = dependent.OrderedDependencies()
+	}
+	listed := make(Protocols, len(ordered))
+	for _, dependency := range ordered {
+		listed[identityOf(dependency)] = true
+	}
+	remaining := make(Protocols)
+	for dependency := range hardDependenciesOf(protocol) {
+		if !listed[identityOf(dependency)] {
+			remaining[dependency] = true
+		}
+	}
+	return ordered, sortProtocols(remaining)
+}
+
+// Gets the hard dependencies of a protocol in a stable order: the
+// ordered ones first, and then the remaining ones, sorted.
+func dependenciesOf(protocol Protocol) []Protocol {
+	ordered, remaining := splitDependenciesOf(protocol)
+	return append(append([]Protocol(nil), ordered...), remaining...)
+}
@@ -0,0 +1,106 @@
+package protocols
+
+import (
+	"errors"
+	"testing"
+)
+
+const orderingRuns = 50
+
+// A protocol with a name, a priority and dependencies.
+type namedOrderingProtocol struct {
+	BaseProtocol
+	name         string
+	priority     int
+	dependencies Protocols
+}
+
+func (protocol *namedOrderingProtocol) Name() string {
+	return protocol.name
+}
+
+func (protocol *namedOrderingProtocol) Priority() int {
+	return protocol.priority
+}
+
+func (protocol *namedOrderingProtocol) Dependencies() Protocols {
+	return protocol.dependencies
+}
+
+func (protocol *namedOrderingProtocol) Handlers() MessageHandlers {
+	return nil
+}
+
+// A protocol with a priority, but no name.
+type unnamedOrderingProtocol struct {
+	BaseProtocol
+	priority int
+}
+
+func (protocol *unnamedOrderingProtocol) Priority() int {
+	return protocol.priority
+}
+
+func (protocol *unnamedOrderingProtocol) Handlers() MessageHandlers {
+	return nil
+}
+
+// Flattens a root protocol many times, and checks the order is
+// always the expected one.
+func assertStableOrder(t *testing.T, root Protocol, expected ...Protocol) {
+	for run := 0; run < orderingRuns; run++ {
+		flat, _, err := flatten([]Protocol{root}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error flattening: %v", err)
+		}
+		if len(flat) != len(expected) {
+			t.Fatalf("run %d: %d protocols flattened, expected %d", run, len(flat), len(expected))
+		}
+		for index, protocol := range flat {
+			if protocol != expected[index] {
+				t.Fatalf("run %d: %s at position %d, expected %s", run, stableNameOf(protocol), index,
+					stableNameOf(expected[index]))
+			}
+		}
+	}
+}
+
+func TestOrderIsStableByName(t *testing.T) {
+	x := &namedOrderingProtocol{name: "x"}
+	y := &namedOrderingProtocol{name: "y"}
+	z := &namedOrderingProtocol{name: "z"}
+	root := &namedOrderingProtocol{name: "r", dependencies: Protocols{z: true, x: true, y: true}}
+	assertStableOrder(t, root, x, y, z, root)
+}
+
+func TestOrderIsStableByPriority(t *testing.T) {
+	x := &unnamedOrderingProtocol{priority: 3}
+	y := &unnamedOrderingProtocol{priority: 1}
+	z := &unnamedOrderingProtocol{priority: 2}
+	root := &namedOrderingProtocol{name: "r", dependencies: Protocols{x: true, y: true, z: true}}
+	assertStableOrder(t, root, y, z, x, root)
+}
+
+func TestOrderIsStableByType(t *testing.T) {
+	x := &namedOrderingProtocol{name: "x"}
+	y := &unnamedOrderingProtocol{}
+	root := &namedOrderingProtocol{name: "r", dependencies: Protocols{x: true, y: true}}
+	// Unnamed protocols are sorted by type name, which starts with "*".
+	assertStableOrder(t, root, y, x, root)
+}
+
+func TestAmbiguousOrderFails(t *testing.T) {
+	x := &unnamedOrderingProtocol{}
+	y := &unnamedOrderingProtocol{}
+	root := &namedOrderingProtocol{name: "r", dependencies: Protocols{x: true, y: true}}
+	if _, _, err := flatten([]Protocol{root}, nil); !errors.Is(err, ErrAmbiguousOrder) {
+		t.Fatalf("expected ErrAmbiguousOrder, got %v", err)
+	}
+
+	sameName := &namedOrderingProtocol{name: "x"}
+	root = &namedOrderingProtocol{name: "r", dependencies: Protocols{&namedOrderingProtocol{name: "x"}: true,
+		sameName: true}}
+	if _, err := NewProtocolsFunnel([]Protocol{root}); !errors.Is(err, ErrAmbiguousOrder) {
+		t.Fatalf("expected ErrAmbiguousOrder, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"runtime/debug"
+	"sync"
+)
+
+// Option to start the protocols in parallel: the protocols in the
+// same dependency level (i.e. not depending, even indirectly, on
+// each other) start concurrently, while the levels start in order.
+// If any protocol panics or vetoes, the protocols started
+// successfully (in any level) are stopped in reverse order as
+// usual. Protocols in the same level must not interfere with each
+// other while starting. In particular, attendant contexts are not
+// thread-safe, so they must not set context values (not even with
+// different keys) but use state keys instead. Stopping is not
+// affected by this option.
+func WithParallelStartup() func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.parallelStartup = true
+	}
+}
+
+// Computes the dependency level of each funneled protocol: 0 for
+// those without funneled dependencies, and one more than the max
+// level among their dependencies otherwise.
+func (composition *composition) dependencyLevels() map[Protocol]int {
+	levels := make(map[Protocol]int, len(composition.flattened))
+	for _, protocol := range composition.flattened {
+		level := 0
+		dependencies := dependenciesOf(protocol)
+		dependencies = append(dependencies, sortProtocols(optionalDependenciesOf(protocol))...)
+		dependencies = append(dependencies, sortProtocols(composition.services.dependencies[identityOf(protocol)])...)
+		for _, dependency := range dependencies {
+			if instance, ok := composition.instanceOf(dependency); ok && levels[instance]+1 > level {
+				level = levels[instance] + 1
+			}
+		}
+		levels[protocol] = level
+	}
+	return levels
+}
+
+// Groups the given protocols by their dependency level, in level
+// order and keeping their relative order inside each level.
+func (composition *composition) groupByLevel(protocols []Protocol) [][]Protocol {
+	var groups [][]Protocol
+	for _, protocol := range protocols {
+		level := composition.levels[protocol]
+		for len(groups) <= level {
+			groups = append(groups, nil)
+		}
+		groups[level] = append(groups[level], protocol)
+	}
+	return groups
+}
+
+// Runs a start callback for each protocol of a group concurrently,
+// and returns the vetoes, and the recovered panics (and their stacks),
+// by index.
+func runConcurrently(group []Protocol, start func(Protocol) error) ([]error, []interface{}, [][]byte) {
+	errs := make([]error, len(group))
+	recovered := make([]interface{}, len(group))
+	stacks := make([][]byte, len(group))
+	var waitGroup sync.WaitGroup
+	for index, protocol := range group {
+		waitGroup.Add(1)
+		go func(index int, protocol Protocol) {
+			defer waitGroup.Done()
+			defer func() {
+				if recovered[index] = recover(); recovered[index] != nil {
+					stacks[index] = debug.Stack()
+				}
+			}()
+			errs[index] = start(protocol)
+		}(index, protocol)
+	}
+	waitGroup.Wait()
+	return errs, recovered, stacks
+}
+
+// Starts the given protocols for a server, level by level, with the
+// protocols in the same level starting concurrently. If any of them
+// panics or vetoes, the next levels are not started, and the server is vetoed
+// and told to stop.
+func (funnel *ProtocolsFunnel) startServerInParallel(server *chasqui.Server, record *serverRecord, protocols []Protocol) {
+	for _, group := range funnel.composition.groupByLevel(protocols) {
+		for _, protocol := range group {
+			funnel.composition.allocateServerState(server, protocol)
+		}
+		errs, recovered, stacks := runConcurrently(group, func(protocol Protocol) error {
+			return startedOf(protocol, server, record.addr)
+		})
+		for index, protocol := range group {
+			if recovered[index] != nil {
+				funnel.serverStartPanicked(server, record, protocol, recovered[index], stacks[index])
+			} else if errs[index] != nil {
+				funnel.serverStartVetoed(server, record, protocol, errs[index])
+			} else {
+				funnel.serverStartSucceeded(server, record, protocol)
+			}
+		}
+		if record.vetoed {
+			// noinspection GoUnhandledErrorResult
+			server.Stop()
+			return
+		}
+	}
+}
+
+// Starts the given protocols for an attendant, level by level, with
+// the protocols in the same level starting concurrently. If any of
+// them panics or vetoes, the next levels are not started, and the attendant is
+// vetoed and told to stop.
+func (funnel *ProtocolsFunnel) startAttendantInParallel(server *chasqui.Server, attendant *chasqui.Attendant,
+	record *attendantRecord, protocols []Protocol) {
+	for _, group := range funnel.composition.groupByLevel(protocols) {
+		for _, protocol := range group {
+			funnel.composition.allocateAttendantState(attendant, protocol)
+		}
+		errs, recovered, stacks := runConcurrently(group, func(protocol Protocol) error {
+			return attendantStartedOf(protocol, server, attendant)
+		})
+		for index, protocol := range group {
+			if recovered[index] != nil {
+				funnel.attendantStartPanicked(server, attendant, record, protocol, recovered[index], stacks[index])
+			} else if errs[index] != nil {
+				funnel.attendantStartVetoed(server, attendant, record, protocol, errs[index])
+			} else {
+				funnel.attendantStartSucceeded(server, attendant, record, protocol)
+			}
+		}
+		if record.vetoed {
+			// noinspection GoUnhandledErrorResult
+			attendant.Stop()
+			return
+		}
+	}
+}
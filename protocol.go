@@ -1,14 +1,26 @@
 package protocols
 
 import (
-	"github.com/universe-10th/chasqui"
-	"net"
+	"fmt"
+	"reflect"
 )
 
 type Protocols map[Protocol]bool
 
 // Implementors of this interface will have the
 // following contract:
+// - Handlers(): They will know all of their handlers
+//   not just at instantiation time but most likely
+//   at design time (in the worst case, they will
+//   know them at instantiation time). They must
+//   guarantee that these handlers will be strictly
+//   immutable.
+//
+// The remaining methods are optional, and declared
+// by separate interfaces (Dependent, ServerStarter,
+// AttendantStarter, AttendantStopper, ServerStopper)
+// the funnel detects. BaseProtocol can be embedded
+// to have defaults for all of them:
 // - Dependencies(): They will know all of their
 //   dependencies at instantiation time and they
 //   must guarantee those dependencies will be
@@ -17,12 +29,6 @@ type Protocols map[Protocol]bool
 //   to require authentication) and, since they
 //   are protocols on their own, they will also
 //   handle their own messages.
-// - Handlers(): They will know all of their handlers
-//   not just at instantiation time but most likely
-//   at design time (in the worst case, they will
-//   know them at instantiation time). As with the
-//   dependencies, they must guarantee that these
-//   handlers will be strictly immutable.
 //
 // Knowing what services does it provide and what does
 // it depend on, the following methods involve all the
@@ -47,10 +53,34 @@ type Protocols map[Protocol]bool
 //   protocol did run AttendantStarted() on the socket
 //   and did not veto it.
 type Protocol interface {
-	Dependencies() Protocols
 	Handlers() MessageHandlers
-	Started(server *chasqui.Server, addr *net.TCPAddr)
-	AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant)
-	AttendantStopped(server *chasqui.Server, attendant *chasqui.Attendant, stopType chasqui.AttendantStopType, err error)
-	Stopped(server *chasqui.Server)
+}
+
+// Protocols may optionally implement this interface
+// to have a human-readable name, which will be used
+// when reporting errors (e.g. dependency cycles or
+// handler conflicts).
+type Named interface {
+	Name() string
+}
+
+// Gets the name of a protocol. Decorated protocols
+// are traversed until a named one is found. If none
+// is named, the type (and address, if it is a pointer)
+// of the protocol is used instead.
+func ProtocolName(protocol Protocol) string {
+	for current := protocol; current != nil; {
+		if named, ok := current.(Named); ok {
+			return named.Name()
+		} else if wrapper, ok := current.(ProtocolWrapper); ok {
+			current = wrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+	identity := identityOf(protocol)
+	if reflect.ValueOf(identity).Kind() == reflect.Ptr {
+		return fmt.Sprintf("%T(%p)", identity, identity)
+	}
+	return fmt.Sprintf("%T", identity)
 }
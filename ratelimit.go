@@ -0,0 +1,250 @@
+package protocols
+
+import (
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"math"
+	"sync"
+	"time"
+)
+
+// The default command to reply with when a message is rate
+// limited (see ReplyOnLimit). Its only argument is the command
+// of the limited message.
+const DefaultRateLimitedCommand = "RATE_LIMITED"
+
+// Limiters tell whether an event is allowed for a key at some
+// instant, counting it if so. Implementations must be safe for
+// concurrent use. NewTokenBucket and NewSlidingWindow create
+// the standard ones.
+type Limiter interface {
+	Allow(key string, now time.Time) bool
+}
+
+// The state of a key in a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket limiter, holding one bucket per key.
+type tokenBucket struct {
+	mutex     sync.Mutex
+	burst     float64
+	interval  time.Duration
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// Creates a token bucket limiter. Each key has a bucket with up to
+// burst tokens (initially full), which gets a new token each given
+// interval. Each allowed event takes a token.
+func NewTokenBucket(burst int, interval time.Duration) Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{burst: float64(burst), interval: interval, buckets: make(map[string]*bucket)}
+}
+
+// The time it takes for a bucket to be full again.
+func (limiter *tokenBucket) fillTime() time.Duration {
+	return time.Duration(limiter.burst) * limiter.interval
+}
+
+func (limiter *tokenBucket) Allow(key string, now time.Time) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if now.Sub(limiter.lastSweep) >= limiter.fillTime() {
+		// Full buckets are just like absent ones.
+		for key, state := range limiter.buckets {
+			if now.Sub(state.last) >= limiter.fillTime() {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.lastSweep = now
+	}
+	state, ok := limiter.buckets[key]
+	if !ok {
+		state = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = state
+	} else if limiter.interval <= 0 {
+		state.tokens = limiter.burst
+	} else if elapsed := now.Sub(state.last); elapsed > 0 {
+		state.tokens = math.Min(limiter.burst, state.tokens+float64(elapsed)/float64(limiter.interval))
+		state.last = now
+	}
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+	return true
+}
+
+// The state of a key in a sliding window.
+type window struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// A sliding window limiter, holding one window per key.
+type slidingWindow struct {
+	mutex     sync.Mutex
+	limit     int
+	length    time.Duration
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+// Creates a sliding window limiter. Each key is allowed up to limit
+// events in any lapse of the given length. The amount of events in
+// the sliding lapse is estimated from the counts of the current and
+// previous fixed windows, so the memory usage does not depend on the
+// limit.
+func NewSlidingWindow(limit int, length time.Duration) Limiter {
+	if length <= 0 {
+		length = time.Second
+	}
+	return &slidingWindow{limit: limit, length: length, windows: make(map[string]*window)}
+}
+
+func (limiter *slidingWindow) Allow(key string, now time.Time) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if now.Sub(limiter.lastSweep) >= 2*limiter.length {
+		// Windows without events in the sliding lapse are just
+		// like absent ones.
+		for key, state := range limiter.windows {
+			if now.Sub(state.start) >= 2*limiter.length {
+				delete(limiter.windows, key)
+			}
+		}
+		limiter.lastSweep = now
+	}
+	state, ok := limiter.windows[key]
+	if !ok {
+		state = &window{start: now}
+		limiter.windows[key] = state
+	}
+	if elapsed := now.Sub(state.start); elapsed >= 2*limiter.length {
+		state.start, state.current, state.previous = now, 0, 0
+	} else if elapsed >= limiter.length {
+		state.start, state.current, state.previous = state.start.Add(limiter.length), 0, state.current
+	}
+	weight := 1 - float64(now.Sub(state.start))/float64(limiter.length)
+	if float64(state.previous)*weight+float64(state.current) >= float64(limiter.limit) {
+		return false
+	}
+	state.current++
+	return true
+}
+
+// Rate keys tell which counter a message goes to.
+type RateKey func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) string
+
+// Keys the messages by their command, so all the attendants share
+// the same counter.
+func ByCommand(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) string {
+	return "command:" + message.Command()
+}
+
+// Keys the messages by their attendant.
+func ByAttendant(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) string {
+	return fmt.Sprintf("attendant:%p", attendant)
+}
+
+// Keys the messages by the identity of their attendant, as told by
+// the given function (e.g. the authenticated user name). Messages
+// of attendants with no identity are keyed by their attendant.
+func ByIdentity(identify func(*chasqui.Server, *chasqui.Attendant) (string, bool)) RateKey {
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) string {
+		if identity, ok := identify(server, attendant); ok {
+			return "identity:" + identity
+		}
+		return ByAttendant(server, attendant, message)
+	}
+}
+
+// What to do with a rate limited message, besides not handling it
+// and reporting it (see WithRateLimited).
+type RateLimitAction int
+
+const (
+	// Just drop the message.
+	DropOnLimit RateLimitAction = iota
+	// Reply to the attendant: RPC messages (see WithRPC) fail with
+	// the reply command as code, and other messages get the reply
+	// command with the limited command as argument.
+	ReplyOnLimit
+	// Disconnect the attendant.
+	DisconnectOnLimit
+)
+
+// Rate limits bundle a limiter, how to key the messages, and what to
+// do when a message is limited.
+type RateLimit struct {
+	Limiter      Limiter
+	Key          RateKey
+	Action       RateLimitAction
+	ReplyCommand string
+}
+
+// Makes a middleware limiting the rate of the handled messages. Key
+// defaults to ByAttendant, and ReplyCommand to
+// DefaultRateLimitedCommand. This is the intended way to limit the rate
+// of a single command (with Chain, while building the handlers of a
+// protocol) or of all the commands of a protocol (as one of its
+// middlewares). Each limiter counts the messages of all the handlers
+// it limits, keyed by Key.
+func Limit(limit RateLimit) MessageMiddleware {
+	if limit.Key == nil {
+		limit.Key = ByAttendant
+	}
+	if limit.ReplyCommand == "" {
+		limit.ReplyCommand = DefaultRateLimitedCommand
+	}
+	return func(handler MessageHandler) MessageHandler {
+		return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+			key := limit.Key(server, attendant, message)
+			if limit.Limiter.Allow(key, time.Now()) {
+				handler(server, attendant, message)
+				return
+			}
+			if funnel, ok := ServingFunnel(server); ok {
+				funnel.rateLimited(server, attendant, message, key)
+			}
+			switch limit.Action {
+			case ReplyOnLimit:
+				if rpcMessage, ok := AsRPC(message); ok {
+					// noinspection GoUnhandledErrorResult
+					rpcMessage.Fail(limit.ReplyCommand, message.Command())
+				} else {
+					// noinspection GoUnhandledErrorResult
+					attendant.Send(limit.ReplyCommand, types.Args{message.Command()}, nil)
+				}
+			case DisconnectOnLimit:
+				// noinspection GoUnhandledErrorResult
+				attendant.Stop()
+			}
+		}
+	}
+}
+
+// Logs and reports a rate limited message.
+func (funnel *ProtocolsFunnel) rateLimited(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	key string) {
+	funnel.logger.Warn("message rate limited", "server", server, "attendant", attendant,
+		"command", message.Command(), "key", key)
+	if funnel.onRateLimited != nil {
+		funnel.onRateLimited(server, attendant, message, key)
+	}
+}
+
+// Option to set the "rate limited" callback to handle when a message
+// hits its rate limit (see Limit), with the key it was counted by.
+func WithRateLimited(callback func(*chasqui.Server, *chasqui.Attendant, types.Message, string)) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onRateLimited = callback
+	}
+}
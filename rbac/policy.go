@@ -0,0 +1,140 @@
+// Package rbac provides a role-based access control protocol for
+// chasqui-protocols funnels. Roles (with inheritance) grant
+// permissions, and handlers require permissions, which are checked
+// against the roles of the users authenticated by the funneled
+// auth.Authenticator before the handlers run.
+package rbac
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrUnknownRole = errors.New("unknown role")
+var ErrRoleCycle = errors.New("a circular inheritance was detected among roles")
+var ErrNilPolicy = errors.New("no policy specified")
+
+// Roles grant their permissions, and the ones of the roles they
+// inherit. A permission "*" grants everything, and a permission
+// ending in ".*" (e.g. "chat.*") grants everything starting with
+// its prefix (e.g. "chat.send").
+type Role struct {
+	Permissions []string `json:"permissions"`
+	Inherits    []string `json:"inherits"`
+}
+
+// Policies tell the permissions of each role, including the ones
+// of their inherited roles. They are immutable.
+type Policy struct {
+	permissions map[string]map[string]bool
+}
+
+// Creates a policy out of its roles. It fails with ErrUnknownRole if
+// a role inherits an undefined one, and with ErrRoleCycle on cycles.
+func NewPolicy(roles map[string]Role) (*Policy, error) {
+	policy := &Policy{permissions: make(map[string]map[string]bool, len(roles))}
+	resolving := make(map[string]bool)
+	var resolve func(name string, chain []string) (map[string]bool, error)
+	resolve = func(name string, chain []string) (map[string]bool, error) {
+		if permissions, ok := policy.permissions[name]; ok {
+			return permissions, nil
+		}
+		role, ok := roles[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s (inherited by %s)", ErrUnknownRole, name, chain[len(chain)-1])
+		}
+		chain = append(chain, name)
+		if resolving[name] {
+			return nil, fmt.Errorf("%w: %s", ErrRoleCycle, strings.Join(chain, " -> "))
+		}
+		resolving[name] = true
+		permissions := make(map[string]bool)
+		for _, permission := range role.Permissions {
+			permissions[permission] = true
+		}
+		for _, inherited := range role.Inherits {
+			inheritedPermissions, err := resolve(inherited, chain)
+			if err != nil {
+				return nil, err
+			}
+			for permission := range inheritedPermissions {
+				permissions[permission] = true
+			}
+		}
+		delete(resolving, name)
+		policy.permissions[name] = permissions
+		return permissions, nil
+	}
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := resolve(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// Loads a policy out of a JSON file like:
+//
+//	{
+//	    "roles": {
+//	        "user": {"permissions": ["chat.send"]},
+//	        "admin": {"permissions": ["chat.kick"], "inherits": ["user"]}
+//	    }
+//	}
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Roles map[string]Role `json:"roles"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewPolicy(config.Roles)
+}
+
+// Tells whether a permission matches a granted one.
+func grants(granted, permission string) bool {
+	if granted == "*" || granted == permission {
+		return true
+	}
+	return strings.HasSuffix(granted, ".*") && strings.HasPrefix(permission, granted[:len(granted)-1])
+}
+
+// Tells whether any of the given roles grants a permission. Unknown
+// roles grant nothing.
+func (policy *Policy) Allows(roles []string, permission string) bool {
+	for _, role := range roles {
+		if policy.permissions[role][permission] {
+			return true
+		}
+		for granted := range policy.permissions[role] {
+			if grants(granted, permission) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Gets the permissions of a role, including the inherited ones,
+// sorted.
+func (policy *Policy) Permissions(role string) []string {
+	permissions := make([]string, 0, len(policy.permissions[role]))
+	for permission := range policy.permissions[role] {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
@@ -0,0 +1,154 @@
+package rbac
+
+import (
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui-protocols"
+	"github.com/universe-10th/chasqui-protocols/auth"
+	"github.com/universe-10th/chasqui/types"
+	"reflect"
+	"sync/atomic"
+)
+
+// The default reply when a command is rejected. Its arguments are
+// the command and the required permission.
+const DefaultForbiddenReply = "FORBIDDEN"
+
+// Rejection handlers process the messages rejected since their
+// attendants lack the required permission.
+type RejectionHandler func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message, permission string)
+
+// The settings of an RBAC protocol.
+type Settings struct {
+	// The roles of the attendants which are not logged in. By
+	// default, none.
+	AnonymousRoles []string
+	// Invoked when a message is rejected. By default, it replies
+	// DefaultForbiddenReply (or fails the RPC message with it as
+	// code).
+	OnRejected RejectionHandler
+}
+
+// Rejects a message by replying DefaultForbiddenReply.
+func forbid(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message, permission string) {
+	args := types.Args{message.Command(), permission}
+	if rpcMessage, ok := protocols.AsRPC(message); ok {
+		// noinspection GoUnhandledErrorResult
+		rpcMessage.Fail(DefaultForbiddenReply, args)
+	} else {
+		// noinspection GoUnhandledErrorResult
+		attendant.Send(DefaultForbiddenReply, args, nil)
+	}
+}
+
+// Authorizer is the service RBAC protocols provide, so other
+// protocols can require permissions (see Permission).
+type Authorizer interface {
+	Roles(server *chasqui.Server, attendant *chasqui.Attendant) []string
+	Allowed(server *chasqui.Server, attendant *chasqui.Attendant, permission string) bool
+	Reject(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message, permission string)
+}
+
+// The Authorizer service, to be listed in the Requires() of the
+// protocols requiring permissions.
+var Service = protocols.ServiceOf((*Authorizer)(nil))
+
+// Protocol is the RBAC protocol. It requires an identity provider,
+// i.e. a protocol providing the auth.Service service, whose users'
+// roles are checked against a policy. It provides the Service
+// service.
+type Protocol struct {
+	protocols.BaseProtocol
+	policy   atomic.Value
+	settings Settings
+}
+
+// Creates an RBAC protocol with the given policy. It fails with
+// ErrNilPolicy if there is no policy.
+func New(policy *Policy, settings Settings) (*Protocol, error) {
+	if policy == nil {
+		return nil, ErrNilPolicy
+	}
+	if settings.OnRejected == nil {
+		settings.OnRejected = forbid
+	}
+	protocol := &Protocol{settings: settings}
+	protocol.policy.Store(policy)
+	return protocol, nil
+}
+
+func (protocol *Protocol) Name() string {
+	return "rbac"
+}
+
+func (protocol *Protocol) Requires() []reflect.Type {
+	return []reflect.Type{auth.Service}
+}
+
+func (protocol *Protocol) Provides() []reflect.Type {
+	return []reflect.Type{Service}
+}
+
+// The protocol has no commands on its own.
+func (protocol *Protocol) Handlers() protocols.MessageHandlers {
+	return nil
+}
+
+// Gets the current policy.
+func (protocol *Protocol) Policy() *Policy {
+	return protocol.policy.Load().(*Policy)
+}
+
+// Replaces the policy (e.g. after loading the config file again).
+// It applies to the next checks. It fails with ErrNilPolicy if
+// there is no policy, keeping the current one.
+func (protocol *Protocol) SetPolicy(policy *Policy) error {
+	if policy == nil {
+		return ErrNilPolicy
+	}
+	protocol.policy.Store(policy)
+	return nil
+}
+
+// Gets the roles of an attendant: the ones of its user, or the
+// anonymous ones if it is not logged in.
+func (protocol *Protocol) Roles(server *chasqui.Server, attendant *chasqui.Attendant) []string {
+	if authenticator, ok := auth.Of(server); ok {
+		if user, ok := authenticator.User(server, attendant); ok {
+			return user.Roles
+		}
+	}
+	return protocol.settings.AnonymousRoles
+}
+
+// Tells whether an attendant has a permission.
+func (protocol *Protocol) Allowed(server *chasqui.Server, attendant *chasqui.Attendant, permission string) bool {
+	return protocol.Policy().Allows(protocol.Roles(server, attendant), permission)
+}
+
+// Rejects a message lacking a permission, through the rejection
+// callback.
+func (protocol *Protocol) Reject(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	permission string) {
+	protocol.settings.OnRejected(server, attendant, message, permission)
+}
+
+// Makes a middleware requiring a permission, through the authorizer
+// funneled for the server, before the handler runs. This is the
+// intended way to declare the permission of a command, with Chain,
+// while building the handlers of a protocol. If no authorizer is
+// funneled, the messages are rejected by replying
+// DefaultForbiddenReply.
+func Permission(permission string) protocols.MessageMiddleware {
+	return func(handler protocols.MessageHandler) protocols.MessageHandler {
+		return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+			provider, ok := protocols.Resolve(server, Service)
+			if !ok {
+				forbid(server, attendant, message, permission)
+			} else if authorizer := provider.(Authorizer); authorizer.Allowed(server, attendant, permission) {
+				handler(server, attendant, message)
+			} else {
+				authorizer.Reject(server, attendant, message, permission)
+			}
+		}
+	}
+}
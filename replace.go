@@ -0,0 +1,236 @@
+package protocols
+
+import (
+	"errors"
+	"github.com/universe-10th/chasqui"
+	"runtime/debug"
+)
+
+var ErrIncompatibleReplacement = errors.New("the replacement protocol changes the other funneled protocols")
+var ErrProtocolReplaced = errors.New("the protocol was replaced in the funnel")
+
+// Protocols may optionally implement this interface to hand
+// their state over to their replacement when they are hot
+// swapped. The funnel allocates the state keys of the target
+// right before the migration, and discards the ones of the
+// migrating protocol right after it. Neither the lifecycle
+// callbacks of the migrating protocol nor the ones of the
+// target are invoked. A migration may panic, which vetoes
+// the involved server or attendant. Decorated protocols (e.g.
+// the namespaced ones) migrate if the decorated one does, and
+// the target is always the undecorated new protocol.
+type Migrator interface {
+	MigrateServer(server *chasqui.Server, target Protocol)
+	MigrateAttendant(server *chasqui.Server, attendant *chasqui.Attendant, target Protocol)
+}
+
+// Gets the migrator of a protocol, if any. Decorated protocols
+// are traversed until a migrator is found.
+func migratorOf(protocol Protocol) (Migrator, bool) {
+	for current := protocol; current != nil; {
+		if migrator, ok := current.(Migrator); ok {
+			return migrator, true
+		} else if wrapper, ok := current.(ProtocolWrapper); ok {
+			current = wrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+	return nil, false
+}
+
+// Sorts a list of started protocols (by identity) in the given
+// order, also putting the replacement (if any) where the replaced
+// protocol was.
+func reorder(started []Protocol, order []Protocol, replaced, replacement Protocol) []Protocol {
+	present := make(Protocols)
+	for _, protocol := range started {
+		if replaced != nil && protocol == replaced {
+			protocol = replacement
+		}
+		present[identityOf(protocol)] = true
+	}
+	var sorted []Protocol
+	for _, protocol := range order {
+		if present[identityOf(protocol)] {
+			sorted = append(sorted, protocol)
+		}
+	}
+	return sorted
+}
+
+// Tells whether a list contains a protocol.
+func contains(protocols []Protocol, protocol Protocol) bool {
+	for _, candidate := range protocols {
+		if candidate == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Migrates the state of a protocol to its replacement for a
+// server. If the migration panics, the server is vetoed and
+// told to stop, and false is returned.
+func (funnel *ProtocolsFunnel) migrateServer(server *chasqui.Server, record *serverRecord, replaced Protocol,
+	migrator Migrator, current, next *composition, replacement Protocol) (migrated bool) {
+	defer func() {
+		current.clearServerState(server, replaced)
+		if recovered := recover(); recovered != nil {
+			next.clearServerState(server, replacement)
+			record.vetoed = true
+			funnel.logger.Error("protocol panicked while migrating for server", "server", server,
+				"protocol", ProtocolName(replacement), "panic", recovered, "stack", string(debug.Stack()))
+			if funnel.onStartedPanic != nil {
+				funnel.onStartedPanic(server, record.addr, replacement, recovered)
+			}
+			// noinspection GoUnhandledErrorResult
+			server.Stop()
+		}
+	}()
+	next.allocateServerState(server, replacement)
+	migrator.MigrateServer(server, identityOf(replacement))
+	return true
+}
+
+// Migrates the state of a protocol to its replacement for an
+// attendant. If the migration panics, the attendant is vetoed
+// and told to stop, and false is returned.
+func (funnel *ProtocolsFunnel) migrateAttendant(attendant *chasqui.Attendant, record *attendantRecord, replaced Protocol,
+	migrator Migrator, current, next *composition, replacement Protocol) (migrated bool) {
+	defer func() {
+		current.clearAttendantState(attendant, replaced)
+		if recovered := recover(); recovered != nil {
+			next.clearAttendantState(attendant, replacement)
+			record.vetoed = true
+			funnel.logger.Error("protocol panicked while migrating for attendant", "server", record.server,
+				"attendant", attendant, "protocol", ProtocolName(replacement), "panic", recovered,
+				"stack", string(debug.Stack()))
+			if funnel.onAttendantStartedPanic != nil {
+				funnel.onAttendantStartedPanic(record.server, attendant, replacement, recovered)
+			}
+			// noinspection GoUnhandledErrorResult
+			attendant.Stop()
+		}
+	}()
+	next.allocateAttendantState(attendant, replacement)
+	migrator.MigrateAttendant(record.server, attendant, identityOf(replacement))
+	return true
+}
+
+// Replaces a funneled protocol with another one, atomically with
+// respect to the funnel lifecycle events, without disconnecting the
+// attendants nor running the lifecycle callbacks of the other
+// protocols. Other protocols depending on the replaced one will
+// depend on the new one instead. The new protocol must not change
+// the other protocols to funnel (i.e. its dependencies must already
+// be funneled), or this method fails with ErrIncompatibleReplacement.
+//
+// If the replaced protocol implements Migrator, it hands its state
+// over to the new one. Otherwise, the replaced protocol is stopped
+// (the attendants get ErrProtocolReplaced as the stop error) and the
+// new one is started for the running attendants and servers. This
+// method may be invoked from anywhere, as AddProtocol.
+func (funnel *ProtocolsFunnel) ReplaceProtocol(oldProtocol, newProtocol Protocol) error {
+	return funnel.change(func(current *composition) (*composition, func(), error) {
+		var replaced Protocol
+		for _, protocol := range current.flattened {
+			if identityOf(protocol) == identityOf(oldProtocol) {
+				replaced = protocol
+			} else if identityOf(protocol) == identityOf(newProtocol) {
+				return nil, nil, ErrProtocolAlreadyAdded
+			}
+		}
+		if replaced == nil {
+			return nil, nil, ErrProtocolNotFound
+		}
+
+		roots := make([]Protocol, len(current.roots))
+		for index, root := range current.roots {
+			if identityOf(root) == identityOf(oldProtocol) {
+				root = newProtocol
+			}
+			roots[index] = root
+		}
+		substitutes := map[Protocol]Protocol{identityOf(oldProtocol): newProtocol}
+		for original, substitute := range current.substitutes {
+			if identityOf(substitute) == identityOf(oldProtocol) {
+				substitute = newProtocol
+			}
+			substitutes[original] = substitute
+		}
+		next, err := funnel.compose(roots, substitutes)
+		if err != nil {
+			return nil, nil, err
+		}
+		var replacement Protocol
+		for _, protocol := range next.flattened {
+			if identityOf(protocol) == identityOf(newProtocol) {
+				replacement = protocol
+			}
+		}
+		if replacement == nil || len(next.flattened) != len(current.flattened) ||
+			len(missingFrom(next.flattened, current.flattened)) != 1 {
+			return nil, nil, ErrIncompatibleReplacement
+		}
+		return next, func() {
+			funnel.swap(current, next, replaced, replacement)
+		}, nil
+	})
+}
+
+// Swaps a protocol for its replacement in the running servers and
+// attendants, either migrating or restarting it, and publishes the
+// new handlers.
+func (funnel *ProtocolsFunnel) swap(current, next *composition, replaced, replacement Protocol) {
+	if migrator, ok := migratorOf(replaced); ok {
+		for server, record := range funnel.servers {
+			if contains(record.started, replaced) {
+				if !funnel.migrateServer(server, record, replaced, migrator, current, next, replacement) {
+					record.started = withoutRemoved(record.started, Protocols{replaced: true})
+				}
+			}
+		}
+		for attendant, record := range funnel.attendants {
+			if contains(record.started, replaced) {
+				if !funnel.migrateAttendant(attendant, record, replaced, migrator, current, next, replacement) {
+					record.started = withoutRemoved(record.started, Protocols{replaced: true})
+				}
+			}
+		}
+	} else {
+		removed := Protocols{replaced: true}
+		for attendant, record := range funnel.attendants {
+			if contains(record.started, replaced) {
+				funnel.safeAttendantStoppedCallback(record.server, attendant, chasqui.AttendantLocalStop,
+					ErrProtocolReplaced, replaced)
+				record.started = withoutRemoved(record.started, removed)
+			}
+		}
+		for server, record := range funnel.servers {
+			if contains(record.started, replaced) {
+				funnel.safeStoppedCallback(server, replaced)
+				record.started = withoutRemoved(record.started, removed)
+			}
+		}
+		funnel.setComposition(next)
+		for server, record := range funnel.servers {
+			if !record.vetoed {
+				funnel.startServer(server, record, []Protocol{replacement})
+			}
+		}
+		for attendant, record := range funnel.attendants {
+			if serverRecord, ok := funnel.servers[record.server]; !record.vetoed && ok && !serverRecord.vetoed {
+				funnel.startAttendant(record.server, attendant, record, []Protocol{replacement})
+			}
+		}
+	}
+
+	for _, record := range funnel.servers {
+		record.started = reorder(record.started, next.flattened, replaced, replacement)
+	}
+	for _, record := range funnel.attendants {
+		record.started = reorder(record.started, next.flattened, replaced, replacement)
+	}
+	funnel.setComposition(next)
+}
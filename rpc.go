@@ -0,0 +1,128 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"sync/atomic"
+)
+
+var ErrAlreadyReplied = errors.New("the request was already replied")
+
+const (
+	DefaultCorrelationKey = "rpc_id"
+	DefaultResultCommand  = "RESULT"
+	DefaultErrorCommand   = "ERROR"
+)
+
+// Settings for the request/response correlation mode,
+// shared by servers (funnels) and clients. Empty fields
+// take their default values.
+type RPCSettings struct {
+	// The keyword argument holding the correlation id.
+	CorrelationKey string
+	// The command used to send successful replies, with
+	// the result as the only positional argument.
+	ResultCommand string
+	// The command used to send failure replies, with the
+	// code and detail as the positional arguments.
+	ErrorCommand string
+}
+
+// Fills the empty fields with their default values.
+func (settings RPCSettings) withDefaults() RPCSettings {
+	if settings.CorrelationKey == "" {
+		settings.CorrelationKey = DefaultCorrelationKey
+	}
+	if settings.ResultCommand == "" {
+		settings.ResultCommand = DefaultResultCommand
+	}
+	if settings.ErrorCommand == "" {
+		settings.ErrorCommand = DefaultErrorCommand
+	}
+	return settings
+}
+
+// Describes a failure reply. Clients get this error when
+// the server invokes Fail on the request.
+type RPCError struct {
+	Code   string
+	Detail interface{}
+}
+
+func (rpcError *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %s: %v", rpcError.Code, rpcError.Detail)
+}
+
+// Messages carrying a correlation id, when the RPC mode is
+// enabled in the funnel, are given to the handlers as this
+// type. The correlation id is removed from the keyword
+// arguments, and can be echoed back with exactly one of
+// the Reply or Fail methods.
+type RPCMessage struct {
+	types.Message
+	attendant *chasqui.Attendant
+	settings  RPCSettings
+	id        interface{}
+	kwArgs    types.KWArgs
+	replied   int32
+}
+
+// The keyword arguments, without the correlation id.
+func (message *RPCMessage) KWArgs() types.KWArgs {
+	return message.kwArgs
+}
+
+// The correlation id sent by the client.
+func (message *RPCMessage) CorrelationID() interface{} {
+	return message.id
+}
+
+// Sends a successful reply, echoing the correlation id.
+func (message *RPCMessage) Reply(result interface{}) error {
+	if !atomic.CompareAndSwapInt32(&message.replied, 0, 1) {
+		return ErrAlreadyReplied
+	}
+	return message.attendant.Send(message.settings.ResultCommand, types.Args{result},
+		types.KWArgs{message.settings.CorrelationKey: message.id})
+}
+
+// Sends a failure reply, echoing the correlation id.
+func (message *RPCMessage) Fail(code string, detail interface{}) error {
+	if !atomic.CompareAndSwapInt32(&message.replied, 0, 1) {
+		return ErrAlreadyReplied
+	}
+	return message.attendant.Send(message.settings.ErrorCommand, types.Args{code, detail},
+		types.KWArgs{message.settings.CorrelationKey: message.id})
+}
+
+// Gets the RPC message out of a message given to a handler,
+// if the message carried a correlation id.
+func AsRPC(message types.Message) (*RPCMessage, bool) {
+	found, ok := findMessage(message, func(message types.Message) bool {
+		_, ok := message.(*RPCMessage)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+	return found.(*RPCMessage), true
+}
+
+// Wraps a message into an RPC message, if it carries a
+// correlation id. Otherwise, returns it unchanged.
+func wrapRPC(settings RPCSettings, attendant *chasqui.Attendant, message types.Message) types.Message {
+	kwArgs := message.KWArgs()
+	id, ok := kwArgs[settings.CorrelationKey]
+	if !ok || id == nil {
+		return message
+	}
+	stripped := make(types.KWArgs, len(kwArgs)-1)
+	for key, value := range kwArgs {
+		if key != settings.CorrelationKey {
+			stripped[key] = value
+		}
+	}
+	return &RPCMessage{Message: message, attendant: attendant, settings: settings, id: id, kwArgs: stripped}
+}
@@ -0,0 +1,158 @@
+package protocols
+
+import (
+	"errors"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRPCTimeout = errors.New("the request timed out")
+var ErrRPCClosed = errors.New("the client stopped before the request was replied")
+
+// The outcome of a request: either the result sent by the
+// server, or an error (a *RPCError sent by the server, or
+// one of ErrRPCTimeout, ErrRPCClosed, or a sending error).
+type RPCResult struct {
+	Result interface{}
+	Err    error
+}
+
+// The client-side counterpart of the RPC mode. It is a client
+// funnel that must be attached to a client attendant via
+// chasqui.FunnelClientWith. Replies to pending requests are
+// captured, while every other event is delegated to the inner
+// funnel (if any).
+type RPCClient struct {
+	client   *chasqui.Attendant
+	funnel   chasqui.ClientFunnel
+	settings RPCSettings
+	mutex    sync.Mutex
+	counter  uint64
+	pending  map[string]chan RPCResult
+}
+
+// Takes a pending request out, if it is still pending.
+func (rpcClient *RPCClient) take(id string) (chan RPCResult, bool) {
+	rpcClient.mutex.Lock()
+	defer rpcClient.mutex.Unlock()
+	channel, ok := rpcClient.pending[id]
+	delete(rpcClient.pending, id)
+	return channel, ok
+}
+
+// Resolves a pending request, if it is still pending.
+func (rpcClient *RPCClient) resolve(id string, result RPCResult) bool {
+	if channel, ok := rpcClient.take(id); ok {
+		channel <- result
+		return true
+	}
+	return false
+}
+
+// Sends a request and returns a channel that will receive
+// exactly one result. A non-positive timeout means the
+// request will wait until it is replied or the client stops.
+func (rpcClient *RPCClient) Go(command string, args types.Args, kwArgs types.KWArgs, timeout time.Duration) <-chan RPCResult {
+	channel := make(chan RPCResult, 1)
+
+	rpcClient.mutex.Lock()
+	rpcClient.counter++
+	id := strconv.FormatUint(rpcClient.counter, 10)
+	rpcClient.pending[id] = channel
+	rpcClient.mutex.Unlock()
+
+	fullKWArgs := make(types.KWArgs, len(kwArgs)+1)
+	for key, value := range kwArgs {
+		fullKWArgs[key] = value
+	}
+	fullKWArgs[rpcClient.settings.CorrelationKey] = id
+	if err := rpcClient.client.Send(command, args, fullKWArgs); err != nil {
+		rpcClient.resolve(id, RPCResult{nil, err})
+	} else if timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			rpcClient.resolve(id, RPCResult{nil, ErrRPCTimeout})
+		})
+	}
+	return channel
+}
+
+// Sends a request and waits for its result.
+func (rpcClient *RPCClient) Call(command string, args types.Args, kwArgs types.KWArgs, timeout time.Duration) (interface{}, error) {
+	result := <-rpcClient.Go(command, args, kwArgs, timeout)
+	return result.Result, result.Err
+}
+
+func (rpcClient *RPCClient) Started(attendant *chasqui.Attendant) {
+	if rpcClient.funnel != nil {
+		rpcClient.funnel.Started(attendant)
+	}
+}
+
+// Captures the replies to pending requests. Other messages
+// are delegated to the inner funnel.
+func (rpcClient *RPCClient) MessageArrived(attendant *chasqui.Attendant, message types.Message) {
+	command := message.Command()
+	if command == rpcClient.settings.ResultCommand || command == rpcClient.settings.ErrorCommand {
+		if id, ok := message.KWArgs()[rpcClient.settings.CorrelationKey].(string); ok {
+			args := message.Args()
+			var result RPCResult
+			if command == rpcClient.settings.ResultCommand {
+				if len(args) > 0 {
+					result.Result = args[0]
+				}
+			} else {
+				rpcError := &RPCError{}
+				if len(args) > 0 {
+					rpcError.Code, _ = args[0].(string)
+				}
+				if len(args) > 1 {
+					rpcError.Detail = args[1]
+				}
+				result.Err = rpcError
+			}
+			if rpcClient.resolve(id, result) {
+				return
+			}
+		}
+	}
+	if rpcClient.funnel != nil {
+		rpcClient.funnel.MessageArrived(attendant, message)
+	}
+}
+
+func (rpcClient *RPCClient) MessageThrottled(attendant *chasqui.Attendant, message types.Message, instant time.Time, lapse time.Duration) {
+	if rpcClient.funnel != nil {
+		rpcClient.funnel.MessageThrottled(attendant, message, instant, lapse)
+	}
+}
+
+// Fails all the pending requests, and then delegates to the
+// inner funnel.
+func (rpcClient *RPCClient) Stopped(attendant *chasqui.Attendant, stopType chasqui.AttendantStopType, err error) {
+	rpcClient.mutex.Lock()
+	pending := rpcClient.pending
+	rpcClient.pending = make(map[string]chan RPCResult)
+	rpcClient.mutex.Unlock()
+	for _, channel := range pending {
+		channel <- RPCResult{nil, ErrRPCClosed}
+	}
+	if rpcClient.funnel != nil {
+		rpcClient.funnel.Stopped(attendant, stopType, err)
+	}
+}
+
+// Creates a new RPC client for a client attendant, delegating
+// the non-reply events to the given funnel (which may be nil).
+// The result must be attached to the client attendant via
+// chasqui.FunnelClientWith.
+func NewRPCClient(client *chasqui.Attendant, funnel chasqui.ClientFunnel, settings RPCSettings) *RPCClient {
+	return &RPCClient{
+		client:   client,
+		funnel:   funnel,
+		settings: settings.withDefaults(),
+		pending:  make(map[string]chan RPCResult),
+	}
+}
@@ -4,60 +4,80 @@ import (
 	"fmt"
 	"github.com/universe-10th/chasqui"
 	"github.com/universe-10th/chasqui-protocols"
+	"github.com/universe-10th/chasqui-protocols/auth"
+	"github.com/universe-10th/chasqui-protocols/rbac"
 	"github.com/universe-10th/chasqui/types"
 	"net"
+	"reflect"
 )
 
+// The chat does not depend on a concrete auth protocol, but on
+// any protocol providing the auth.Authenticator service, so it has
+// no hard dependencies (BaseProtocol provides the default).
 type ChatProtocol struct {
-	auth *AuthProtocol
+	protocols.BaseProtocol
 }
 
-func (protocol *ChatProtocol) Dependencies() protocols.Protocols {
-	return protocols.Protocols{
-		protocol.auth: true,
+func (protocol *ChatProtocol) Name() string {
+	return "chat"
+}
+
+func (protocol *ChatProtocol) Requires() []reflect.Type {
+	return []reflect.Type{auth.Service, rbac.Service}
+}
+
+// Gets the authenticator funneled for the server.
+func (protocol *ChatProtocol) authenticator(server *chasqui.Server) auth.Authenticator {
+	authenticator, _ := auth.Of(server)
+	return authenticator
+}
+
+// All the chat commands require the user to be logged in.
+func (protocol *ChatProtocol) Middlewares() []protocols.MessageMiddleware {
+	return []protocols.MessageMiddleware{auth.Required}
+}
+
+// The arguments are validated by the funnel before the handlers run.
+func (protocol *ChatProtocol) Schemas() map[string]*protocols.MessageSchema {
+	return map[string]*protocols.MessageSchema{
+		"MSG": {
+			Args: []protocols.ArgSpec{{Type: protocols.StringArg, Constraints: []protocols.ArgConstraint{protocols.MinLength(1)}}},
+		},
+		"PMSG": {
+			Args: []protocols.ArgSpec{
+				{Type: protocols.StringArg},
+				{Type: protocols.StringArg, Constraints: []protocols.ArgConstraint{protocols.MinLength(1)}},
+			},
+		},
 	}
 }
 
 func (protocol *ChatProtocol) Handlers() protocols.MessageHandlers {
 	return protocols.MessageHandlers{
-		"MSG": protocol.auth.AuthRequired(func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
-			args := message.Args()
-			kwArgs := message.KWArgs()
-			if len(args) != 1 || len(kwArgs) != 0 {
-				// noinspection GoUnhandledErrorResult
-				attendant.Send("INVALID_FORMAT", types.Args{"MSG", "Expected 1 positional (string) argument, and no keyword arguments"}, nil)
-			} else if text, ok := args[0].(string); !ok {
+		"MSG": protocols.Chain(func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+			text := message.Args()[0].(string)
+			authenticator := protocol.authenticator(server)
+			user, _ := authenticator.User(server, attendant)
+			for attendant := range authenticator.LoggedIn(server) {
 				// noinspection GoUnhandledErrorResult
-				attendant.Send("INVALID_FORMAT", types.Args{"MSG", "The content must be a string"}, nil)
-			} else {
-				user, _ := attendant.Context("User")
-				for _, attendant := range protocol.auth.serverLogins[server] {
-					// noinspection GoUnhandledErrorResult
-					attendant.Send("MSG_RECEIVED", types.Args{user.(User).nick, text}, nil)
-				}
+				attendant.Send("MSG_RECEIVED", types.Args{user.Name, text}, nil)
 			}
-		}),
-		"PMSG": protocol.auth.AuthRequired(func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		}, rbac.Permission("chat.send")),
+		"PMSG": protocols.Chain(func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
 			args := message.Args()
-			kwArgs := message.KWArgs()
-			if len(args) != 2 || len(kwArgs) != 0 {
-				// noinspection GoUnhandledErrorResult
-				attendant.Send("INVALID_FORMAT", types.Args{"PMSG", "Expected 2 positional (string) arguments: user and content, and no keyword arguments"}, nil)
-			} else if targetName, ok := args[0].(string); !ok {
-				// noinspection GoUnhandledErrorResult
-				attendant.Send("INVALID_FORMAT", types.Args{"PMSG", "The target username must be a string"}, nil)
-			} else if text, ok := args[1].(string); !ok {
-				// noinspection GoUnhandledErrorResult
-				attendant.Send("INVALID_FORMAT", types.Args{"PMSG", "The content must be a string"}, nil)
-			} else if attendant2, ok := protocol.auth.serverLogins[server][targetName]; !ok {
+			targetName, text := args[0].(string), args[1].(string)
+			authenticator := protocol.authenticator(server)
+			if targets := authenticator.Attendants(server, targetName); len(targets) == 0 {
 				// noinspection GoUnhandledErrorResult
 				attendant.Send("INVALID_TARGET", types.Args{"PMSG", "The target is not logged in"}, nil)
 			} else {
-				source, _ := attendant.Context("User")
-				// noinspection GoUnhandledErrorResult
-				attendant2.Send("MSG_RECEIVED", types.Args{source.(User).nick, text}, nil)
+				source, _ := authenticator.User(server, attendant)
+				for _, target := range targets {
+					// noinspection GoUnhandledErrorResult
+					target.Send("MSG_RECEIVED", types.Args{source.Name, text}, nil)
+				}
 			}
-		}),
+		}, rbac.Permission("chat.whisper")),
 	}
 }
 
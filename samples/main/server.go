@@ -3,15 +3,54 @@ package main
 import (
 	"github.com/universe-10th/chasqui"
 	"github.com/universe-10th/chasqui-protocols"
+	"github.com/universe-10th/chasqui-protocols/auth"
+	"github.com/universe-10th/chasqui-protocols/rbac"
 	"github.com/universe-10th/chasqui/marshalers/json"
+	"github.com/universe-10th/chasqui/types"
 )
 
-var auth = &AuthProtocol{
-	serverConns:  make(map[*chasqui.Server]map[*chasqui.Attendant]bool),
-	serverLogins: make(map[*chasqui.Server]map[string]*chasqui.Attendant),
+// The users are kept in memory for this sample. Real servers use
+// auth.LoadFileStore(...) or an auth.StoreFunc instead.
+func makeUsers() auth.CredentialStore {
+	users := auth.NewMemoryStore()
+	users.Set("pepe", "pepe$123", "user")
+	users.Set("toto", "toto$123", "guest")
+	users.Set("carlos", "carlos$123", "admin")
+	return users
 }
-var chat = &ChatProtocol{auth}
-var funnel, _ = protocols.NewProtocolsFunnel([]protocols.Protocol{chat, auth})
+
+// The roles are defined in code for this sample. Real servers use
+// rbac.LoadPolicy(...) instead.
+func makePolicy() *rbac.Policy {
+	policy, err := rbac.NewPolicy(map[string]rbac.Role{
+		"guest": {Permissions: []string{"chat.send"}},
+		"user":  {Permissions: []string{"chat.whisper"}, Inherits: []string{"guest"}},
+		"admin": {Permissions: []string{"chat.*"}, Inherits: []string{"user"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+func makeRBAC() *rbac.Protocol {
+	protocol, err := rbac.New(makePolicy(), rbac.Settings{})
+	if err != nil {
+		panic(err)
+	}
+	return protocol
+}
+
+var authProtocol = auth.New(makeUsers(), auth.Settings{MaxAttempts: 5})
+var rbacProtocol = makeRBAC()
+var chat = &ChatProtocol{}
+var funnel, _ = protocols.NewProtocolsFunnel(
+	[]protocols.Protocol{chat, authProtocol, rbacProtocol},
+	protocols.WithMessageInvalid(func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message, err *protocols.ValidationError) {
+		// noinspection GoUnhandledErrorResult
+		attendant.Send("INVALID_FORMAT", types.Args{message.Command(), err.Error()}, nil)
+	}),
+)
 
 func MakeServer() *chasqui.Server {
 	return chasqui.NewServer(
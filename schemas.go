@@ -0,0 +1,350 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidMessage = errors.New("the message does not match the command schema")
+
+// The type an argument must have. Numbers are compared by
+// value rather than by Go type, since most marshalers (e.g.
+// JSON) decode all the numbers as float64.
+type ArgType int
+
+const (
+	AnyArg ArgType = iota
+	StringArg
+	NumberArg
+	IntegerArg
+	BoolArg
+	ListArg
+	MapArg
+)
+
+func (argType ArgType) String() string {
+	switch argType {
+	case StringArg:
+		return "string"
+	case NumberArg:
+		return "number"
+	case IntegerArg:
+		return "integer"
+	case BoolArg:
+		return "bool"
+	case ListArg:
+		return "list"
+	case MapArg:
+		return "map"
+	default:
+		return "any"
+	}
+}
+
+// Tells whether a value satisfies this type.
+func (argType ArgType) Matches(value interface{}) bool {
+	switch argType {
+	case StringArg:
+		_, ok := value.(string)
+		return ok
+	case NumberArg:
+		_, ok := asNumber(value)
+		return ok
+	case IntegerArg:
+		number, ok := asNumber(value)
+		return ok && number == math.Trunc(number)
+	case BoolArg:
+		_, ok := value.(bool)
+		return ok
+	case ListArg:
+		return value != nil && reflect.TypeOf(value).Kind() == reflect.Slice
+	case MapArg:
+		return value != nil && reflect.TypeOf(value).Kind() == reflect.Map
+	default:
+		return true
+	}
+}
+
+// Constraints check a value which already satisfies the
+// type of the argument, and return an error describing
+// why the value is not valid, or nil.
+type ArgConstraint func(value interface{}) error
+
+// Describes a single (positional or keyword) argument.
+// Optional positional arguments must be the last ones.
+type ArgSpec struct {
+	Type        ArgType
+	Optional    bool
+	Constraints []ArgConstraint
+}
+
+// Describes the arguments a command expects. Unless the
+// extra keyword arguments are allowed, keyword arguments
+// not described here will be rejected.
+type MessageSchema struct {
+	Args             []ArgSpec
+	KWArgs           map[string]ArgSpec
+	AllowExtraKWArgs bool
+}
+
+// Protocols may optionally implement this interface to
+// declare a schema for (some of) their commands. Messages
+// not matching the schema of their command will not reach
+// the handler, and will be reported to the callback set by
+// the WithMessageInvalid option instead.
+type SchemaProvider interface {
+	Schemas() map[string]*MessageSchema
+}
+
+// A single problem found while validating a message. The
+// argument is "#n" for the n-th positional argument, the
+// key for keyword arguments, or empty when the problem is
+// about the arguments count.
+type ArgumentIssue struct {
+	Argument string
+	Reason   string
+}
+
+// Describes all the problems found while validating a
+// message against its schema. It satisfies errors.Is
+// against the ErrInvalidMessage sentinel.
+type ValidationError struct {
+	Command string
+	Issues  []ArgumentIssue
+}
+
+func (validationError *ValidationError) Error() string {
+	issues := make([]string, len(validationError.Issues))
+	for index, issue := range validationError.Issues {
+		if issue.Argument == "" {
+			issues[index] = issue.Reason
+		} else {
+			issues[index] = issue.Argument + ": " + issue.Reason
+		}
+	}
+	return fmt.Sprintf("%s: command %q: %s", ErrInvalidMessage.Error(), validationError.Command,
+		strings.Join(issues, "; "))
+}
+
+func (validationError *ValidationError) Is(target error) bool {
+	return target == ErrInvalidMessage
+}
+
+// Handling an invalid message involves the server, the
+// involved attendant, the received message and the error
+// describing why it is not valid.
+type MessageInvalidHandler func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	err *ValidationError)
+
+// Checks a single argument, and returns the reason it is not
+// valid, or an empty string.
+func (spec ArgSpec) check(value interface{}) string {
+	if !spec.Type.Matches(value) {
+		return "expected " + spec.Type.String()
+	}
+	for _, constraint := range spec.Constraints {
+		if err := constraint(value); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// Validates a message against this schema. Returns nil if the
+// message is valid.
+func (schema *MessageSchema) Validate(message types.Message) *ValidationError {
+	var issues []ArgumentIssue
+	args := message.Args()
+	kwArgs := message.KWArgs()
+
+	required := 0
+	for _, spec := range schema.Args {
+		if !spec.Optional {
+			required++
+		}
+	}
+	if len(args) < required || len(args) > len(schema.Args) {
+		var reason string
+		if required == len(schema.Args) {
+			reason = fmt.Sprintf("expected %d positional arguments, got %d", required, len(args))
+		} else {
+			reason = fmt.Sprintf("expected %d to %d positional arguments, got %d", required, len(schema.Args), len(args))
+		}
+		issues = append(issues, ArgumentIssue{"", reason})
+	} else {
+		for index, value := range args {
+			if reason := schema.Args[index].check(value); reason != "" {
+				issues = append(issues, ArgumentIssue{fmt.Sprintf("#%d", index), reason})
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(schema.KWArgs) {
+		spec := schema.KWArgs[key]
+		if value, ok := kwArgs[key]; !ok {
+			if !spec.Optional {
+				issues = append(issues, ArgumentIssue{key, "required"})
+			}
+		} else if reason := spec.check(value); reason != "" {
+			issues = append(issues, ArgumentIssue{key, reason})
+		}
+	}
+	if !schema.AllowExtraKWArgs {
+		for _, key := range sortedKeys(kwArgs) {
+			if _, ok := schema.KWArgs[key]; !ok {
+				issues = append(issues, ArgumentIssue{key, "unexpected"})
+			}
+		}
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+	return &ValidationError{message.Command(), issues}
+}
+
+// Gets the keys of a map, sorted, so the issues are always
+// reported in the same order.
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Wraps a handler so it only runs when the message matches the
+// schema. Otherwise, the invalid message handler runs.
+func validated(handler MessageHandler, schema *MessageSchema, onInvalid MessageInvalidHandler) MessageHandler {
+	if handler == nil || schema == nil {
+		return handler
+	}
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		if err := schema.Validate(message); err != nil {
+			onInvalid(server, attendant, message, err)
+		} else {
+			handler(server, attendant, message)
+		}
+	}
+}
+
+// Gets the numeric value of any Go number.
+func asNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int8:
+		return float64(number), true
+	case int16:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint:
+		return float64(number), true
+	case uint8:
+		return float64(number), true
+	case uint16:
+		return float64(number), true
+	case uint32:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	default:
+		return 0, false
+	}
+}
+
+// Gets the length of a string (in runes), list or map.
+func lengthOf(value interface{}) (int, bool) {
+	if text, ok := value.(string); ok {
+		return utf8.RuneCountInString(text), true
+	} else if value == nil {
+		return 0, false
+	}
+	switch reflected := reflect.ValueOf(value); reflected.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return reflected.Len(), true
+	default:
+		return 0, false
+	}
+}
+
+// Requires a string, list or map to have at least the given length.
+func MinLength(length int) ArgConstraint {
+	return func(value interface{}) error {
+		if actual, ok := lengthOf(value); !ok {
+			return errors.New("length not applicable")
+		} else if actual < length {
+			return fmt.Errorf("length must be at least %d", length)
+		}
+		return nil
+	}
+}
+
+// Requires a string, list or map to have at most the given length.
+func MaxLength(length int) ArgConstraint {
+	return func(value interface{}) error {
+		if actual, ok := lengthOf(value); !ok {
+			return errors.New("length not applicable")
+		} else if actual > length {
+			return fmt.Errorf("length must be at most %d", length)
+		}
+		return nil
+	}
+}
+
+// Requires a number to be at least the given value.
+func Min(min float64) ArgConstraint {
+	return func(value interface{}) error {
+		if number, ok := asNumber(value); !ok {
+			return errors.New("expected number")
+		} else if number < min {
+			return fmt.Errorf("must be at least %v", min)
+		}
+		return nil
+	}
+}
+
+// Requires a number to be at most the given value.
+func Max(max float64) ArgConstraint {
+	return func(value interface{}) error {
+		if number, ok := asNumber(value); !ok {
+			return errors.New("expected number")
+		} else if number > max {
+			return fmt.Errorf("must be at most %v", max)
+		}
+		return nil
+	}
+}
+
+// Requires a value to be one of the given ones. Numbers are
+// compared by value.
+func OneOf(values ...interface{}) ArgConstraint {
+	return func(value interface{}) error {
+		number, isNumber := asNumber(value)
+		for _, allowed := range values {
+			if allowedNumber, ok := asNumber(allowed); ok && isNumber {
+				if allowedNumber == number {
+					return nil
+				}
+			} else if reflect.DeepEqual(allowed, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v", values)
+	}
+}
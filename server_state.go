@@ -0,0 +1,91 @@
+package protocols
+
+import (
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"reflect"
+)
+
+// Server state keys identify a per-server value owned by
+// a protocol. Each key holds its own values, one for each
+// server the owner is started for. The funnel allocates a
+// fresh value for each key right before the owner's Started,
+// and discards it right after the owner's Stopped, so each
+// server gets its own isolated state.
+type ServerStateKey struct {
+	stateValues[*chasqui.Server]
+	owner Protocol
+}
+
+// The protocol owning this key.
+func (key *ServerStateKey) Owner() Protocol {
+	return key.owner
+}
+
+// Protocols may optionally implement this interface to have
+// the funnel manage their per-server state.
+type ServerStateOwner interface {
+	ServerStateKeys() []*ServerStateKey
+}
+
+// Creates a server state key owned by a protocol. Its values
+// will be of the same type of the prototype, and allocated in
+// the same way of the attendant state keys.
+func NewServerStateKey(owner Protocol, name string, prototype interface{}) *ServerStateKey {
+	return newServerStateKey(owner, name, typeOfPrototype(prototype))
+}
+
+// Creates a server state key for values of a given type.
+func newServerStateKey(owner Protocol, name string, valueType reflect.Type) *ServerStateKey {
+	return &ServerStateKey{newStateValues[*chasqui.Server](name, valueType), owner}
+}
+
+// Typed server state keys wrap a server state key whose values
+// are of type T, as TypedStateKey does for attendants. The
+// wrapped key is the one to declare in ServerStateKeys().
+type TypedServerStateKey[T any] struct {
+	typedValues[*chasqui.Server, T]
+	key *ServerStateKey
+}
+
+// Creates a typed server state key owned by a protocol. Its
+// values are allocated as in NewServerStateKey.
+func NewTypedServerStateKey[T any](owner Protocol, name string) *TypedServerStateKey[T] {
+	key := newServerStateKey(owner, name, typeOf[T]())
+	return &TypedServerStateKey[T]{typedValues[*chasqui.Server, T]{&key.stateValues}, key}
+}
+
+// The wrapped server state key, to declare in ServerStateKeys().
+func (key *TypedServerStateKey[T]) Key() *ServerStateKey {
+	return key.key
+}
+
+// Gets and checks the server state keys of a protocol.
+func serverStateKeysOf(protocol Protocol) ([]*ServerStateKey, error) {
+	owner, ok := protocol.(ServerStateOwner)
+	if !ok {
+		return nil, nil
+	}
+	keys := owner.ServerStateKeys()
+	for _, key := range keys {
+		if identityOf(key.owner) != identityOf(protocol) {
+			return nil, fmt.Errorf("%w: key %s of %s declared by %s", ErrStateKeyOwner, key.name,
+				ProtocolName(key.owner), ProtocolName(protocol))
+		}
+	}
+	return keys, nil
+}
+
+// Allocates the state of a protocol for a server.
+func (composition *composition) allocateServerState(server *chasqui.Server, protocol Protocol) {
+	for _, key := range composition.serverStateKeys[protocol] {
+		key.allocate(server)
+	}
+}
+
+// Discards the state of a protocol for a server.
+func (composition *composition) clearServerState(server *chasqui.Server, protocol Protocol) {
+	for _, key := range composition.serverStateKeys[protocol] {
+		key.discard(server)
+	}
+}
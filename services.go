@@ -0,0 +1,152 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"reflect"
+	"strings"
+)
+
+var ErrMissingProvider = errors.New("no funneled protocol provides a required service")
+var ErrAmbiguousProvider = errors.New("several funneled protocols provide a required service")
+var ErrInvalidProvider = errors.New("a protocol does not implement a service it claims to provide")
+
+// Describes a problem while resolving a service: either a
+// required service has no providers, or it has many, or a
+// provider does not implement the service. It satisfies
+// errors.Is against the matching sentinel error.
+type ServiceError struct {
+	Service   reflect.Type
+	Consumer  Protocol
+	Providers []Protocol
+	sentinel  error
+}
+
+func (serviceError *ServiceError) Error() string {
+	names := make([]string, len(serviceError.Providers))
+	for index, provider := range serviceError.Providers {
+		names[index] = ProtocolName(provider)
+	}
+	switch serviceError.sentinel {
+	case ErrMissingProvider:
+		return fmt.Sprintf("%s: %s required by %s", serviceError.sentinel.Error(), serviceError.Service,
+			ProtocolName(serviceError.Consumer))
+	case ErrAmbiguousProvider:
+		return fmt.Sprintf("%s: %s required by %s is provided by %s", serviceError.sentinel.Error(),
+			serviceError.Service, ProtocolName(serviceError.Consumer), strings.Join(names, ", "))
+	default:
+		return fmt.Sprintf("%s: %s does not implement %s", serviceError.sentinel.Error(),
+			strings.Join(names, ", "), serviceError.Service)
+	}
+}
+
+func (serviceError *ServiceError) Is(target error) bool {
+	return target == serviceError.sentinel
+}
+
+// Gets the service type out of a nil pointer to an interface,
+// like ServiceOf((*Authenticator)(nil)). It panics if the
+// argument is not a pointer to an interface.
+func ServiceOf(pointerToInterface interface{}) reflect.Type {
+	pointerType := reflect.TypeOf(pointerToInterface)
+	if pointerType == nil || pointerType.Kind() != reflect.Ptr || pointerType.Elem().Kind() != reflect.Interface {
+		panic(fmt.Sprintf("ServiceOf expects a pointer to an interface, got %T", pointerToInterface))
+	}
+	return pointerType.Elem()
+}
+
+// Protocols may optionally implement this interface to tell
+// which services (interface types, see ServiceOf) they provide.
+// They must implement those interfaces.
+type ServiceProvider interface {
+	Provides() []reflect.Type
+}
+
+// Protocols may optionally implement this interface to require
+// services instead of depending on concrete protocols. Each
+// required service must be provided by exactly one funneled
+// protocol, which becomes a dependency of the consumer. Use
+// Resolve to get the provider at runtime.
+type ServiceConsumer interface {
+	Requires() []reflect.Type
+}
+
+// Gets the provided services of a protocol, if any.
+func providedServicesOf(protocol Protocol) []reflect.Type {
+	if provider, ok := protocol.(ServiceProvider); ok {
+		return provider.Provides()
+	}
+	return nil
+}
+
+// Gets the required services of a protocol, if any.
+func requiredServicesOf(protocol Protocol) []reflect.Type {
+	if consumer, ok := protocol.(ServiceConsumer); ok {
+		return consumer.Requires()
+	}
+	return nil
+}
+
+// The resolved services of a composition: the dependencies each
+// consumer gets because of its required services, and the unique
+// provider of each service.
+type serviceIndex struct {
+	dependencies map[Protocol]Protocols
+	providers    map[reflect.Type]Protocol
+}
+
+// Resolves the services among the funneled protocols.
+func resolveServices(flat []Protocol) (*serviceIndex, error) {
+	candidates := make(map[reflect.Type][]Protocol)
+	for _, protocol := range flat {
+		for _, service := range providedServicesOf(protocol) {
+			if !reflect.TypeOf(identityOf(protocol)).Implements(service) {
+				return nil, &ServiceError{service, nil, []Protocol{protocol}, ErrInvalidProvider}
+			}
+			candidates[service] = append(candidates[service], protocol)
+		}
+	}
+
+	index := &serviceIndex{make(map[Protocol]Protocols), make(map[reflect.Type]Protocol)}
+	for service, providers := range candidates {
+		if len(providers) == 1 {
+			index.providers[service] = identityOf(providers[0])
+		}
+	}
+	for _, protocol := range flat {
+		for _, service := range requiredServicesOf(protocol) {
+			switch providers := candidates[service]; len(providers) {
+			case 0:
+				return nil, &ServiceError{service, protocol, nil, ErrMissingProvider}
+			case 1:
+				identity := identityOf(protocol)
+				if index.dependencies[identity] == nil {
+					index.dependencies[identity] = make(Protocols)
+				}
+				index.dependencies[identity][providers[0]] = true
+			default:
+				return nil, &ServiceError{service, protocol, providers, ErrAmbiguousProvider}
+			}
+		}
+	}
+	return index, nil
+}
+
+// Gets the protocol providing a service in this funnel, if any
+// protocol (and only one) provides it. It is safe to invoke this
+// method from anywhere, including handlers and lifecycle callbacks.
+func (funnel *ProtocolsFunnel) Resolve(service reflect.Type) (Protocol, bool) {
+	provider, ok := funnel.publishedComposition().services.providers[service]
+	return provider, ok
+}
+
+// Gets the protocol providing a service for a running server, if
+// any protocol (and only one) provides it. Consumers use this
+// function to get their providers, e.g. inside their handlers.
+func Resolve(server *chasqui.Server, service reflect.Type) (Protocol, bool) {
+	if funnel, ok := ServingFunnel(server); ok {
+		return funnel.Resolve(service)
+	}
+	return nil, false
+}
@@ -0,0 +1,124 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"reflect"
+)
+
+var ErrStateKeyOwner = errors.New("a protocol declared a state key owned by another protocol")
+var ErrStateType = errors.New("the value does not match the type of the state key")
+
+// State keys identify a per-attendant value owned by a
+// protocol. Each key holds its own values, one for each
+// attendant the owner is started for, so protocols cannot
+// clobber each other's state, and a type every value must
+// match. The values are kept apart from the (unsynchronized)
+// attendant context, so they are safe to use from handlers
+// running in any goroutine. The funnel allocates a fresh
+// value (see NewStateKey) for each key right before the
+// owner's AttendantStarted, and discards it right after the
+// owner's AttendantStopped.
+type StateKey struct {
+	stateValues[*chasqui.Attendant]
+	owner Protocol
+}
+
+// The protocol owning this key.
+func (key *StateKey) Owner() Protocol {
+	return key.owner
+}
+
+// Creates a fresh value of a type: a pointer to a new zero
+// value for pointer types, an empty map for map types, and
+// the zero value for other types.
+func allocateValue(valueType reflect.Type) interface{} {
+	switch valueType.Kind() {
+	case reflect.Ptr:
+		return reflect.New(valueType.Elem()).Interface()
+	case reflect.Map:
+		return reflect.MakeMap(valueType).Interface()
+	default:
+		return reflect.Zero(valueType).Interface()
+	}
+}
+
+// Gets the type of the state values out of a prototype. A nil
+// prototype stands for any type.
+func typeOfPrototype(prototype interface{}) reflect.Type {
+	if valueType := reflect.TypeOf(prototype); valueType != nil {
+		return valueType
+	}
+	return reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+// Protocols may optionally implement this interface to have
+// the funnel manage their per-attendant state.
+type StateOwner interface {
+	StateKeys() []*StateKey
+}
+
+// Creates a state key owned by a protocol. Its values will be
+// of the same type of the prototype (e.g. (*Session)(nil) for
+// values of type *Session, which will be allocated as pointers
+// to new zero Session values).
+func NewStateKey(owner Protocol, name string, prototype interface{}) *StateKey {
+	return newStateKey(owner, name, typeOfPrototype(prototype))
+}
+
+// Creates a state key for values of a given type.
+func newStateKey(owner Protocol, name string, valueType reflect.Type) *StateKey {
+	return &StateKey{newStateValues[*chasqui.Attendant](name, valueType), owner}
+}
+
+// Typed state keys wrap a state key whose values are of type
+// T, so handlers get and set them without type assertions.
+// The wrapped key is the one to declare in StateKeys().
+type TypedStateKey[T any] struct {
+	typedValues[*chasqui.Attendant, T]
+	key *StateKey
+}
+
+// Creates a typed state key owned by a protocol. Its values
+// are allocated as in NewStateKey (e.g. a pointer to a new
+// zero Session value for NewTypedStateKey[*Session]).
+func NewTypedStateKey[T any](owner Protocol, name string) *TypedStateKey[T] {
+	key := newStateKey(owner, name, typeOf[T]())
+	return &TypedStateKey[T]{typedValues[*chasqui.Attendant, T]{&key.stateValues}, key}
+}
+
+// The wrapped state key, to declare in StateKeys().
+func (key *TypedStateKey[T]) Key() *StateKey {
+	return key.key
+}
+
+// Gets and checks the state keys of a protocol.
+func stateKeysOf(protocol Protocol) ([]*StateKey, error) {
+	owner, ok := protocol.(StateOwner)
+	if !ok {
+		return nil, nil
+	}
+	keys := owner.StateKeys()
+	for _, key := range keys {
+		if identityOf(key.owner) != identityOf(protocol) {
+			return nil, fmt.Errorf("%w: key %s of %s declared by %s", ErrStateKeyOwner, key.name,
+				ProtocolName(key.owner), ProtocolName(protocol))
+		}
+	}
+	return keys, nil
+}
+
+// Allocates the state of a protocol for an attendant.
+func (composition *composition) allocateAttendantState(attendant *chasqui.Attendant, protocol Protocol) {
+	for _, key := range composition.stateKeys[protocol] {
+		key.allocate(attendant)
+	}
+}
+
+// Clears the state of a protocol for an attendant.
+func (composition *composition) clearAttendantState(attendant *chasqui.Attendant, protocol Protocol) {
+	for _, key := range composition.stateKeys[protocol] {
+		key.discard(attendant)
+	}
+}
@@ -0,0 +1,100 @@
+package protocols
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Holds the values of a state key, one for each holder (i.e.
+// each server or attendant the owner is started for), and
+// checks them against the type of the key. Both the attendant
+// and the server state keys are built on it.
+type stateValues[K comparable] struct {
+	name      string
+	valueType reflect.Type
+	mutex     sync.RWMutex
+	values    map[K]interface{}
+}
+
+func newStateValues[K comparable](name string, valueType reflect.Type) stateValues[K] {
+	return stateValues[K]{name: name, valueType: valueType, values: make(map[K]interface{})}
+}
+
+// The name of this key, for diagnostic purposes.
+func (values *stateValues[K]) Name() string {
+	return values.name
+}
+
+// The type of the values of this key.
+func (values *stateValues[K]) Type() reflect.Type {
+	return values.valueType
+}
+
+// Gets the value of this key for a server or attendant. It
+// returns false if the owner is not (yet, or anymore) started
+// for it.
+func (values *stateValues[K]) Get(holder K) (interface{}, bool) {
+	values.mutex.RLock()
+	defer values.mutex.RUnlock()
+	value, ok := values.values[holder]
+	return value, ok
+}
+
+// Sets the value of this key for a server or attendant. It
+// panics with ErrStateType if the value does not match the key.
+func (values *stateValues[K]) Set(holder K, value interface{}) {
+	if value == nil {
+		switch values.valueType.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+			value = reflect.Zero(values.valueType).Interface()
+		default:
+			panic(fmt.Errorf("%w: %s expects %s, got nil", ErrStateType, values.name, values.valueType))
+		}
+	} else if !reflect.TypeOf(value).AssignableTo(values.valueType) {
+		panic(fmt.Errorf("%w: %s expects %s, got %T", ErrStateType, values.name, values.valueType, value))
+	}
+	values.mutex.Lock()
+	defer values.mutex.Unlock()
+	values.values[holder] = value
+}
+
+// Allocates a fresh value for a server or attendant.
+func (values *stateValues[K]) allocate(holder K) {
+	value := allocateValue(values.valueType)
+	values.mutex.Lock()
+	defer values.mutex.Unlock()
+	values.values[holder] = value
+}
+
+// Discards the value of a server or attendant.
+func (values *stateValues[K]) discard(holder K) {
+	values.mutex.Lock()
+	defer values.mutex.Unlock()
+	delete(values.values, holder)
+}
+
+// Gives typed access to the values of a state key, for the
+// typed state keys.
+type typedValues[K comparable, T any] struct {
+	values *stateValues[K]
+}
+
+// Gets the value of this key for a server or attendant. It
+// returns the zero value and false if the owner is not (yet,
+// or anymore) started for it.
+func (typed typedValues[K, T]) Get(holder K) (T, bool) {
+	value, ok := typed.values.Get(holder)
+	result, _ := value.(T)
+	return result, ok
+}
+
+// Sets the value of this key for a server or attendant.
+func (typed typedValues[K, T]) Set(holder K, value T) {
+	typed.values.Set(holder, value)
+}
+
+// Gets the type of the values of a typed state key.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
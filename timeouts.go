@@ -0,0 +1,182 @@
+package protocols
+
+import (
+	"context"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"sync"
+	"time"
+)
+
+// Protocols may optionally implement this interface to
+// declare deadlines for their handlers, by command name.
+// Commands not listed here use the funnel's default one
+// (see WithHandlerTimeout), if any. A non-positive value
+// disables the deadline for that command.
+type TimeoutProvider interface {
+	Timeouts() map[string]time.Duration
+}
+
+// Messages handled with a deadline are wrapped into this
+// type, which carries the context of the handling. The
+// context is cancelled when the deadline is reached or the
+// handling ends.
+type timedMessage struct {
+	types.Message
+	ctx      context.Context
+	finish   func()
+	mutex    sync.Mutex
+	detached bool
+}
+
+// The wrapped message.
+func (message *timedMessage) Unwrap() types.Message {
+	return message.Message
+}
+
+// The context of the handling.
+func (message *timedMessage) Context() context.Context {
+	return message.ctx
+}
+
+// Tells that the handling continues elsewhere (e.g. in a
+// worker pool), and returns the function to invoke when
+// it ends. It returns nil if it was already detached.
+func (message *timedMessage) detach() func() {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	if message.detached {
+		return nil
+	}
+	message.detached = true
+	return message.finish
+}
+
+// Messages carrying the context of their handling.
+type contextualMessage interface {
+	Context() context.Context
+}
+
+// Messages wrapping other messages.
+type messageWrapper interface {
+	Unwrap() types.Message
+}
+
+// Finds, in a message or the messages it wraps, one of the
+// given type.
+func findMessage(message types.Message, match func(types.Message) bool) (types.Message, bool) {
+	for message != nil {
+		if match(message) {
+			return message, true
+		} else if wrapper, ok := message.(messageWrapper); ok {
+			message = wrapper.Unwrap()
+		} else {
+			break
+		}
+	}
+	return nil, false
+}
+
+// Detaches the handling of a message, if it has a deadline.
+// The returned function (which may be nil) must be invoked
+// when the handling ends.
+func detachMessage(message types.Message) func() {
+	found, ok := findMessage(message, func(message types.Message) bool {
+		_, ok := message.(*timedMessage)
+		return ok
+	})
+	if !ok {
+		return nil
+	}
+	return found.(*timedMessage).detach()
+}
+
+// Gets the context of the handling of a message: the one
+// with its deadline, if any, or the attendant's one.
+func MessageContext(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) context.Context {
+	found, ok := findMessage(message, func(message types.Message) bool {
+		_, ok := message.(contextualMessage)
+		return ok
+	})
+	if ok {
+		return found.(contextualMessage).Context()
+	}
+	return AttendantContext(server, attendant)
+}
+
+// Wraps a handler so it runs with a deadline. When the deadline
+// is reached, the context of the handling is cancelled and the
+// timeout is reported, while the handler keeps running (it is
+// expected to honor the context).
+func (funnel *ProtocolsFunnel) timed(handler MessageHandler, timeout time.Duration) MessageHandler {
+	if handler == nil || timeout <= 0 {
+		return handler
+	}
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(AttendantContext(server, attendant), timeout)
+		timer := time.AfterFunc(timeout, func() {
+			funnel.messageTimeout(server, attendant, message, time.Since(start))
+		})
+		timedMessage := &timedMessage{Message: message, ctx: ctx, finish: func() {
+			timer.Stop()
+			cancel()
+		}}
+		defer func() {
+			if finish := timedMessage.detach(); finish != nil {
+				finish()
+			}
+		}()
+		handler(server, attendant, timedMessage)
+	}
+}
+
+// Wraps the handlers of a protocol so they run with their
+// deadlines, if any.
+func (funnel *ProtocolsFunnel) timedHandlers(protocol Protocol, handlers MessageHandlers) MessageHandlers {
+	var timeouts map[string]time.Duration
+	if provider, ok := protocol.(TimeoutProvider); ok {
+		timeouts = provider.Timeouts()
+	}
+	if len(timeouts) == 0 && funnel.handlerTimeout <= 0 {
+		return handlers
+	}
+	timedHandlers := make(MessageHandlers, len(handlers))
+	for command, handler := range handlers {
+		timeout, ok := timeouts[command]
+		if !ok {
+			timeout = funnel.handlerTimeout
+		}
+		timedHandlers[command] = funnel.timed(handler, timeout)
+	}
+	return timedHandlers
+}
+
+// Logs and reports a handler reaching its deadline.
+func (funnel *ProtocolsFunnel) messageTimeout(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message,
+	elapsed time.Duration) {
+	funnel.logger.Warn("message handler timed out", "server", server, "attendant", attendant,
+		"command", message.Command(), "elapsed", elapsed)
+	if funnel.onMessageTimeout != nil {
+		funnel.onMessageTimeout(server, attendant, message, elapsed)
+	}
+}
+
+// Option to set the default deadline for the handlers of the
+// commands without their own (see TimeoutProvider). By default,
+// handlers have no deadline.
+func WithHandlerTimeout(timeout time.Duration) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.handlerTimeout = timeout
+	}
+}
+
+// Option to set the "message timeout" callback to handle when a
+// handler reaches its deadline. It is invoked with the elapsed
+// time while the handler is still running, so it can reply with
+// an error (e.g. by failing the RPC message) and report it.
+func WithMessageTimeout(callback func(*chasqui.Server, *chasqui.Attendant, types.Message, time.Duration)) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onMessageTimeout = callback
+	}
+}
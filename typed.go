@@ -0,0 +1,262 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/types"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var ErrInvalidTypedHandler = errors.New("typed handlers must be functions like func(*Call, T) where T is a struct or pointer to struct")
+
+// Calls bundle the involved server, attendant and message
+// of a typed handler invocation.
+type Call struct {
+	Server    *chasqui.Server
+	Attendant *chasqui.Attendant
+	Message   types.Message
+}
+
+// Describes how a request struct field is bound: either
+// by position (the index among the positional fields) or
+// by keyword.
+type boundField struct {
+	index    int
+	keyword  string
+	optional bool
+}
+
+var callType = reflect.TypeOf((*Call)(nil))
+
+// Parses the fields of a request struct. Exported fields are
+// bound to positional arguments in declaration order, unless
+// they have a `kwarg:"name"` tag (then they are bound to that
+// keyword argument) or an `arg:"-"` tag (then they are not
+// bound at all). Positional fields may be tagged `arg:"optional"`
+// (they must be the last ones) while keyword fields are
+// optional unless tagged like `kwarg:"name,required"`.
+func parseRequestType(requestType reflect.Type) ([]boundField, error) {
+	var fields []boundField
+	seenOptional := false
+	for index := 0; index < requestType.NumField(); index++ {
+		field := requestType.Field(index)
+		if field.PkgPath != "" {
+			continue
+		}
+		argTag := field.Tag.Get("arg")
+		if argTag == "-" {
+			continue
+		}
+		if kwArgTag, ok := field.Tag.Lookup("kwarg"); ok {
+			parts := strings.Split(kwArgTag, ",")
+			required := len(parts) > 1 && parts[1] == "required"
+			fields = append(fields, boundField{index, parts[0], !required})
+		} else {
+			optional := argTag == "optional"
+			if seenOptional && !optional {
+				return nil, fmt.Errorf("%w: required positional field %s after an optional one",
+					ErrInvalidTypedHandler, field.Name)
+			}
+			seenOptional = seenOptional || optional
+			fields = append(fields, boundField{index, "", optional})
+		}
+	}
+	return fields, nil
+}
+
+// Assigns a decoded value into a Go value, coercing numbers
+// and traversing lists, maps and nested structs (which are
+// decoded from maps by their kwarg tag or field name). The
+// range of integers is checked before converting them, since
+// converting out of range floats is implementation-defined.
+func assign(target reflect.Value, value interface{}) error {
+	if value == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	source := reflect.ValueOf(value)
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if number, ok := asNumber(value); !ok {
+			return fmt.Errorf("expected integer, got %T", value)
+		} else if number != math.Trunc(number) || math.IsInf(number, 0) {
+			return fmt.Errorf("expected integer, got %v", number)
+		} else if limit := math.Ldexp(1, target.Type().Bits()-1); number < -limit || number >= limit {
+			return fmt.Errorf("%v overflows %s", number, target.Type())
+		} else {
+			target.SetInt(int64(number))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if number, ok := asNumber(value); !ok {
+			return fmt.Errorf("expected non-negative integer, got %T", value)
+		} else if number != math.Trunc(number) || number < 0 || math.IsInf(number, 0) {
+			return fmt.Errorf("expected non-negative integer, got %v", number)
+		} else if number >= math.Ldexp(1, target.Type().Bits()) {
+			return fmt.Errorf("%v overflows %s", number, target.Type())
+		} else {
+			target.SetUint(uint64(number))
+		}
+	case reflect.Float32, reflect.Float64:
+		if number, ok := asNumber(value); !ok {
+			return fmt.Errorf("expected number, got %T", value)
+		} else {
+			target.SetFloat(number)
+		}
+	case reflect.Ptr:
+		element := reflect.New(target.Type().Elem())
+		if err := assign(element.Elem(), value); err != nil {
+			return err
+		}
+		target.Set(element)
+	case reflect.Slice:
+		if source.Kind() != reflect.Slice {
+			return fmt.Errorf("expected list, got %T", value)
+		}
+		slice := reflect.MakeSlice(target.Type(), source.Len(), source.Len())
+		for index := 0; index < source.Len(); index++ {
+			if err := assign(slice.Index(index), source.Index(index).Interface()); err != nil {
+				return fmt.Errorf("[%d]: %s", index, err)
+			}
+		}
+		target.Set(slice)
+	case reflect.Map:
+		if source.Kind() != reflect.Map {
+			return fmt.Errorf("expected map, got %T", value)
+		}
+		result := reflect.MakeMapWithSize(target.Type(), source.Len())
+		iterator := source.MapRange()
+		for iterator.Next() {
+			key := reflect.New(target.Type().Key()).Elem()
+			if err := assign(key, iterator.Key().Interface()); err != nil {
+				return fmt.Errorf("key %v: %s", iterator.Key().Interface(), err)
+			}
+			element := reflect.New(target.Type().Elem()).Elem()
+			if err := assign(element, iterator.Value().Interface()); err != nil {
+				return fmt.Errorf("[%v]: %s", iterator.Key().Interface(), err)
+			}
+			result.SetMapIndex(key, element)
+		}
+		target.Set(result)
+	case reflect.Struct:
+		if source.Kind() != reflect.Map || source.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("expected map, got %T", value)
+		}
+		for index := 0; index < target.NumField(); index++ {
+			field := target.Type().Field(index)
+			if field.PkgPath != "" {
+				continue
+			}
+			key := field.Name
+			if kwArgTag, ok := field.Tag.Lookup("kwarg"); ok {
+				key = strings.Split(kwArgTag, ",")[0]
+			}
+			if element := source.MapIndex(reflect.ValueOf(key).Convert(source.Type().Key())); element.IsValid() {
+				if err := assign(target.Field(index), element.Interface()); err != nil {
+					return fmt.Errorf("%s: %s", key, err)
+				}
+			}
+		}
+	default:
+		if !source.Type().AssignableTo(target.Type()) {
+			return fmt.Errorf("expected %s, got %T", target.Type(), value)
+		}
+		target.Set(source)
+	}
+	return nil
+}
+
+// Binds a message into a new request struct value.
+func bindRequest(requestType reflect.Type, fields []boundField, message types.Message) (reflect.Value, *ValidationError) {
+	var issues []ArgumentIssue
+	request := reflect.New(requestType).Elem()
+	args := message.Args()
+	kwArgs := message.KWArgs()
+
+	position := 0
+	required := 0
+	for _, field := range fields {
+		if field.keyword == "" {
+			if !field.optional {
+				required++
+			}
+			if position < len(args) {
+				if err := assign(request.Field(field.index), args[position]); err != nil {
+					issues = append(issues, ArgumentIssue{fmt.Sprintf("#%d", position), err.Error()})
+				}
+			}
+			position++
+		} else if value, ok := kwArgs[field.keyword]; ok {
+			if err := assign(request.Field(field.index), value); err != nil {
+				issues = append(issues, ArgumentIssue{field.keyword, err.Error()})
+			}
+		} else if !field.optional {
+			issues = append(issues, ArgumentIssue{field.keyword, "required"})
+		}
+	}
+	if len(args) < required || len(args) > position {
+		issues = append(issues, ArgumentIssue{"", fmt.Sprintf("expected %d to %d positional arguments, got %d",
+			required, position, len(args))})
+	}
+
+	if len(issues) != 0 {
+		return request, &ValidationError{message.Command(), issues}
+	}
+	return request, nil
+}
+
+// Creates a message handler out of a typed function like
+// func(*Call, T), where T is a struct (or a pointer to a
+// struct) the message will be bound into. If the binding
+// fails, the function is not invoked and the invalid
+// message handler (if any) is invoked instead.
+func NewTypedHandler(function interface{}, onInvalid MessageInvalidHandler) (MessageHandler, error) {
+	if function == nil {
+		return nil, ErrInvalidTypedHandler
+	}
+	functionValue := reflect.ValueOf(function)
+	functionType := functionValue.Type()
+	if functionType.Kind() != reflect.Func || functionType.NumIn() != 2 || functionType.NumOut() != 0 ||
+		functionType.In(0) != callType {
+		return nil, ErrInvalidTypedHandler
+	}
+	requestType := functionType.In(1)
+	isPointer := requestType.Kind() == reflect.Ptr
+	if isPointer {
+		requestType = requestType.Elem()
+	}
+	if requestType.Kind() != reflect.Struct {
+		return nil, ErrInvalidTypedHandler
+	}
+	fields, err := parseRequestType(requestType)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(server *chasqui.Server, attendant *chasqui.Attendant, message types.Message) {
+		if request, err := bindRequest(requestType, fields, message); err != nil {
+			if onInvalid != nil {
+				onInvalid(server, attendant, message, err)
+			}
+		} else {
+			if isPointer {
+				request = request.Addr()
+			}
+			functionValue.Call([]reflect.Value{
+				reflect.ValueOf(&Call{server, attendant, message}), request,
+			})
+		}
+	}, nil
+}
+
+// Like NewTypedHandler, but panics if the function is not valid.
+// Intended to be used while building the handlers of a protocol.
+func Typed(function interface{}, onInvalid MessageInvalidHandler) MessageHandler {
+	if handler, err := NewTypedHandler(function, onInvalid); err != nil {
+		panic(err)
+	} else {
+		return handler
+	}
+}
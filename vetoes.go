@@ -0,0 +1,94 @@
+package protocols
+
+import (
+	"github.com/universe-10th/chasqui"
+	"net"
+)
+
+// VetoingStarter is an optional extension of Protocol to veto
+// servers without panicking. When a protocol implements it, the
+// funnel invokes StartedE instead of Started: a non-nil error
+// vetoes the server (which is told to stop) and is reported to
+// the "started veto" callback instead of the panic one, which
+// stays reserved for actual crashes.
+type VetoingStarter interface {
+	StartedE(server *chasqui.Server, addr *net.TCPAddr) error
+}
+
+// VetoingAttendantStarter is an optional extension of Protocol to
+// veto attendants without panicking. When a protocol implements
+// it, the funnel invokes AttendantStartedE instead of
+// AttendantStarted: a non-nil error vetoes the attendant (which
+// is told to stop) and is reported to the "attendant started
+// veto" callback instead of the panic one.
+type VetoingAttendantStarter interface {
+	AttendantStartedE(server *chasqui.Server, attendant *chasqui.Attendant) error
+}
+
+// Starts a protocol for a server, preferring StartedE over
+// Started, if it implements any of them.
+func startedOf(protocol Protocol, server *chasqui.Server, addr *net.TCPAddr) error {
+	if starter, ok := protocol.(VetoingStarter); ok {
+		return starter.StartedE(server, addr)
+	}
+	if starter, ok := protocol.(ServerStarter); ok {
+		starter.Started(server, addr)
+	}
+	return nil
+}
+
+// Starts a protocol for an attendant, preferring AttendantStartedE
+// over AttendantStarted, if it implements any of them.
+func attendantStartedOf(protocol Protocol, server *chasqui.Server, attendant *chasqui.Attendant) error {
+	if starter, ok := protocol.(VetoingAttendantStarter); ok {
+		return starter.AttendantStartedE(server, attendant)
+	}
+	if starter, ok := protocol.(AttendantStarter); ok {
+		starter.AttendantStarted(server, attendant)
+	}
+	return nil
+}
+
+// Reports a protocol that vetoed a server, and vetoes the server.
+// The server must be told to stop later.
+func (funnel *ProtocolsFunnel) serverStartVetoed(server *chasqui.Server, record *serverRecord, protocol Protocol,
+	err error) {
+	funnel.composition.clearServerState(server, protocol)
+	record.vetoed = true
+	funnel.logger.Warn("protocol vetoed the server", "server", server, "protocol", ProtocolName(protocol),
+		"error", err)
+	if funnel.onStartedVeto != nil {
+		funnel.onStartedVeto(server, record.addr, protocol, err)
+	}
+}
+
+// Reports a protocol that vetoed an attendant, and vetoes the
+// attendant. The attendant must be told to stop later.
+func (funnel *ProtocolsFunnel) attendantStartVetoed(server *chasqui.Server, attendant *chasqui.Attendant,
+	record *attendantRecord, protocol Protocol, err error) {
+	funnel.composition.clearAttendantState(attendant, protocol)
+	record.vetoed = true
+	funnel.logger.Warn("protocol vetoed the attendant", "server", server, "attendant", attendant,
+		"protocol", ProtocolName(protocol), "error", err)
+	if funnel.onAttendantStartedVeto != nil {
+		funnel.onAttendantStartedVeto(server, attendant, protocol, err)
+	}
+}
+
+// Option to set the "server started veto" callback to handle when a
+// protocol refuses to initialize for a server (by returning an error
+// from StartedE).
+func WithStartedVeto(callback func(*chasqui.Server, *net.TCPAddr, Protocol, error)) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onStartedVeto = callback
+	}
+}
+
+// Option to set the "attendant started veto" callback to handle when
+// a protocol refuses to initialize for an attendant (by returning an
+// error from AttendantStartedE).
+func WithAttendantStartedVeto(callback func(*chasqui.Server, *chasqui.Attendant, Protocol, error)) func(target *ProtocolsFunnel) {
+	return func(target *ProtocolsFunnel) {
+		target.onAttendantStartedVeto = callback
+	}
+}